@@ -7,7 +7,15 @@ import (
 )
 
 func notImplemented(loc *SrcLoc, msg string) error {
-	return newParserError(loc, fmt.Sprintf("%s not implemented", msg))
+	return newParseError(ParseErrorInternal, loc, fmt.Sprintf("%s not implemented", msg))
+}
+
+// error for a name not found in the symtab, with similar names that are visible
+func newUndeclaredError(symtab *symTab, name string, loc *SrcLoc, msg string) *ParseError {
+	err := newParseError(ParseErrorUndeclared, loc, msg)
+	err.End.Col += int32(utf8.RuneCountInString(name))
+	err.Suggestions = symtab.suggest(name)
+	return err
 }
 
 type analyzeFlags uint32
@@ -26,10 +34,57 @@ type astExpression interface {
 	analyzeExpr(*symTab) (execExpression, error)
 }
 
+// top level declarations and, in script mode, statements
+type astScript struct {
+	funcs []*astNamedFuncDef
+	vars  []*astStmtVar
+	stmts []astStatement
+}
+
+// analyze top level statements as the body of a function without parameters;
+// 'var' statements assign to globals that must already be declared
+func (e *astScript) analyzeEntry(symtab *symTab) (*execExprFuncDef, error) {
+	new_symtab := newFuncSymTab(symtab, nil)
+	stmts := make([]execStatement, 0, len(e.stmts))
+	var errs ParseErrorList
+	for _, ast_s := range e.stmts {
+		if ast_var, ok := ast_s.(*astStmtVar); ok {
+			exec_s, err := ast_var.analyzeGlobalAssignment(new_symtab)
+			if err != nil {
+				errs.add(err)
+				continue
+			}
+			stmts = append(stmts, exec_s)
+			continue
+		}
+		exec_s, err := ast_s.analyzeStmt(new_symtab, 0)
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		stmts = append(stmts, exec_s)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	stmts = append(stmts, &execStmtReturn{&execExprConst{entryEnd}})
+
+	ret := &execExprFuncDef{
+		name:       scriptFuncName,
+		num_params: 0,
+		body: &execStmtBlock{
+			stmts: stmts,
+		},
+	}
+	new_symtab.fn.finish(ret)
+	return ret, nil
+}
+
 // named func def
 type astNamedFuncDef struct {
 	name string
 	def  *astExprFuncDef
+	loc  SrcLoc
 }
 
 func (e *astNamedFuncDef) dump(indent int) {
@@ -43,12 +98,14 @@ func (e *astNamedFuncDef) analyze(symtab *symTab) (*execExprFuncDef, error) {
 	if err != nil {
 		return nil, err
 	}
+	def.name = e.name
 	return def, nil
 }
 
 // block
 type astStmtBlock struct {
 	stmts []astStatement
+	loc   SrcLoc
 }
 
 func (e *astStmtBlock) dump(indent int) {
@@ -62,42 +119,37 @@ func (e *astStmtBlock) dump(indent int) {
 	fmt.Printf("}")
 }
 
-func (e *astStmtBlock) analyzePart(var_value execExpression, stmts []astStatement, symtab *symTab, flags analyzeFlags) (*execStmtBlock, error) {
-	ret_stmts := make([]execStatement, 0)
-	for i := 0; i < len(stmts); i++ {
-		ast_s := stmts[i]
+func (e *astStmtBlock) analyze(symtab *symTab, flags analyzeFlags) (*execStmtBlock, error) {
+	// names declared in the block are visible until its end
+	block_symtab := newSymTab(symtab, nil)
+
+	// keep going after an error to report all errors in the block
+	var errs ParseErrorList
+	stmts := make([]execStatement, 0, len(e.stmts))
+	for _, ast_s := range e.stmts {
+		var exec_s execStatement
+		var err error
 		if ast_var, ok := ast_s.(*astStmtVar); ok {
-			var_value, err := ast_var.val.analyzeExpr(symtab)
-			if err != nil {
-				return nil, err
-			}
-			new_symtab := newSymTab(symtab, []string{ast_var.ident})
-			block, err := e.analyzePart(var_value, stmts[i+1:], new_symtab, flags)
-			if err != nil {
-				return nil, err
-			}
-			ret_stmts = append(ret_stmts, block)
-			break
+			exec_s, err = ast_var.analyzeLocal(block_symtab)
 		} else {
-			exec_s, err := ast_s.analyzeStmt(symtab, flags)
-			if err != nil {
-				return nil, err
-			}
-			ret_stmts = append(ret_stmts, exec_s)
+			exec_s, err = ast_s.analyzeStmt(block_symtab, flags)
 		}
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		stmts = append(stmts, exec_s)
+	}
+	if len(errs) > 0 {
+		return nil, errs
 	}
 
 	ret := &execStmtBlock{
-		var_value: var_value,
-		stmts:     ret_stmts,
+		stmts: stmts,
 	}
 	return ret, nil
 }
 
-func (e *astStmtBlock) analyze(symtab *symTab, flags analyzeFlags) (*execStmtBlock, error) {
-	return e.analyzePart(nil, e.stmts, symtab, flags)
-}
-
 func (e *astStmtBlock) analyzeStmt(symtab *symTab, flags analyzeFlags) (execStatement, error) {
 	return e.analyze(symtab, flags)
 }
@@ -118,8 +170,52 @@ func (e *astStmtVar) dump(indent int) {
 	fmt.Printf(";")
 }
 
+func (e *astStmtVar) analyzeValue(symtab *symTab) (execExpression, error) {
+	if e.val == nil {
+		return &execExprConst{NewValueNull()}, nil
+	}
+	val, err := e.val.analyzeExpr(symtab)
+	if err != nil {
+		return nil, err
+	}
+	nameFuncDef(val, e.ident)
+	return val, nil
+}
+
+// the variable is declared after its value is analyzed, so the value
+// sees any variable of the same name declared before
+func (e *astStmtVar) analyzeLocal(symtab *symTab) (execStatement, error) {
+	val, err := e.analyzeValue(symtab)
+	symtab.declare(e.ident)
+	if err != nil {
+		return nil, err
+	}
+	ret := &execStmtVar{
+		name: e.ident,
+		val:  val,
+	}
+	symtab.resolve(e.ident, &ret.ref)
+	return ret, nil
+}
+
+func (e *astStmtVar) analyzeGlobalAssignment(symtab *symTab) (execStatement, error) {
+	assign := &execExprVarAssignment{
+		name: e.ident,
+		loc:  e.loc,
+	}
+	if !symtab.resolve(e.ident, &assign.ref) {
+		return nil, newParseError(ParseErrorUndeclared, &e.loc, fmt.Sprintf("unknown variable: '%s'", e.ident))
+	}
+	val, err := e.analyzeValue(symtab)
+	if err != nil {
+		return nil, err
+	}
+	assign.val = val
+	return &execStmtExpression{assign}, nil
+}
+
 func (e *astStmtVar) analyzeStmt(symtab *symTab, flags analyzeFlags) (execStatement, error) {
-	return nil, newParserError(&e.loc, "trying to analyze 'var' statement")
+	return nil, newParseError(ParseErrorInternal, &e.loc, "trying to analyze 'var' statement")
 }
 
 // if
@@ -127,6 +223,7 @@ type astStmtIf struct {
 	test_expr  astExpression
 	true_stmt  astStatement
 	false_stmt astStatement
+	loc        SrcLoc
 }
 
 func (e *astStmtIf) dump(indent int) {
@@ -175,6 +272,7 @@ func (e *astStmtIf) analyzeStmt(symtab *symTab, flags analyzeFlags) (execStateme
 type astStmtWhile struct {
 	test_expr astExpression
 	stmt      astStatement
+	loc       SrcLoc
 }
 
 func (e *astStmtWhile) dump(indent int) {
@@ -204,6 +302,7 @@ func (e *astStmtWhile) analyze(symtab *symTab, flags analyzeFlags) (*execStmtWhi
 	ret := &execStmtWhile{
 		test_expr: test_expr,
 		stmt:      stmt,
+		loc:       e.loc,
 	}
 	return ret, nil
 }
@@ -215,6 +314,7 @@ func (e *astStmtWhile) analyzeStmt(symtab *symTab, flags analyzeFlags) (execStat
 // return
 type astStmtReturn struct {
 	retval astExpression
+	loc    SrcLoc
 }
 
 func (e *astStmtReturn) dump(indent int) {
@@ -256,7 +356,7 @@ func (e *astStmtBreak) dump(indent int) {
 
 func (e *astStmtBreak) analyze(symtab *symTab, flags analyzeFlags) (*execStmtBreak, error) {
 	if (flags & analyzeFlagsAllowBreak) == 0 {
-		return nil, newParserError(&e.loc, "break not allowed here")
+		return nil, newParseError(ParseErrorBreak, &e.loc, "break not allowed here")
 	}
 	ret := &execStmtBreak{}
 	return ret, nil
@@ -268,7 +368,8 @@ func (e *astStmtBreak) analyzeStmt(symtab *symTab, flags analyzeFlags) (execStat
 
 // expression statement
 type astStmtExpression struct {
-	e astExpression
+	e   astExpression
+	loc SrcLoc
 }
 
 func (e *astStmtExpression) dump(indent int) {
@@ -292,9 +393,24 @@ func (e *astStmtExpression) analyzeStmt(symtab *symTab, flags analyzeFlags) (exe
 }
 
 // func def
+const anonymousFuncName = "<anonymous>"
+const scriptFuncName = "<script>"
+
+// returned by the entry function of a script that ends without 'return',
+// so Run() goes on to the next script
+var entryEnd Value = &ValueString{"<end of script>"}
+
+// give a name to a function literal assigned to a variable
+func nameFuncDef(expr execExpression, name string) {
+	if def, ok := expr.(*execExprFuncDef); ok && def.name == anonymousFuncName {
+		def.name = name
+	}
+}
+
 type astExprFuncDef struct {
-	params []string
-	body   *astStmtBlock
+	params     []string
+	param_locs []SrcLoc
+	body       *astStmtBlock
 }
 
 func (e *astExprFuncDef) dump(indent int) {
@@ -310,7 +426,7 @@ func (e *astExprFuncDef) dump(indent int) {
 }
 
 func (e *astExprFuncDef) analyze(symtab *symTab) (*execExprFuncDef, error) {
-	new_symtab := newSymTab(symtab, e.params)
+	new_symtab := newFuncSymTab(symtab, e.params)
 
 	body, err := e.body.analyze(new_symtab, 0)
 	if err != nil {
@@ -318,9 +434,12 @@ func (e *astExprFuncDef) analyze(symtab *symTab) (*execExprFuncDef, error) {
 	}
 
 	ret := &execExprFuncDef{
+		name:       anonymousFuncName,
+		params:     e.params,
 		num_params: len(e.params),
 		body:       body,
 	}
+	new_symtab.fn.finish(ret)
 	return ret, nil
 }
 
@@ -331,6 +450,7 @@ func (e *astExprFuncDef) analyzeExpr(symtab *symTab) (execExpression, error) {
 // map literal
 type astExprMapLiteral struct {
 	elements [][2]astExpression
+	loc      SrcLoc
 }
 
 func (e *astExprMapLiteral) dump(indent int) {
@@ -359,6 +479,7 @@ func (e *astExprMapLiteral) analyzeExpr(symtab *symTab) (execExpression, error)
 	}
 	ret := &execExprMapLiteral{
 		elements: elements,
+		loc:      e.loc,
 	}
 	return ret, nil
 }
@@ -366,6 +487,7 @@ func (e *astExprMapLiteral) analyzeExpr(symtab *symTab) (execExpression, error)
 // vector literal
 type astExprVectorLiteral struct {
 	elements []astExpression
+	loc      SrcLoc
 }
 
 func (e *astExprVectorLiteral) dump(indent int) {
@@ -390,6 +512,7 @@ func (e *astExprVectorLiteral) analyzeExpr(symtab *symTab) (execExpression, erro
 	}
 	ret := &execExprVectorLiteral{
 		elements: elements,
+		loc:      e.loc,
 	}
 	return ret, nil
 }
@@ -443,14 +566,12 @@ func (e *astExprIdent) dump(indent int) {
 }
 
 func (e *astExprIdent) analyze(symtab *symTab) (*execExprIdent, error) {
-	env_index, var_index := symtab.getVar(e.name)
-	if var_index < 0 {
-		return nil, newParserError(&e.loc, fmt.Sprintf("undeclared variable '%s'", e.name))
-	}
 	ret := &execExprIdent{
-		env_index: env_index,
-		var_index: var_index,
-		loc:       e.loc,
+		name: e.name,
+		loc:  e.loc,
+	}
+	if !symtab.resolve(e.name, &ret.ref) {
+		return nil, newUndeclaredError(symtab, e.name, &e.loc, fmt.Sprintf("undeclared variable '%s'", e.name))
 	}
 	return ret, nil
 }
@@ -462,6 +583,7 @@ func (e *astExprIdent) analyzeExpr(symtab *symTab) (execExpression, error) {
 // string
 type astExprString struct {
 	str string
+	loc SrcLoc
 }
 
 func (e *astExprString) dump(indent int) {
@@ -471,6 +593,8 @@ func (e *astExprString) dump(indent int) {
 func (e *astExprString) analyze(symtab *symTab) (*execExprString, error) {
 	ret := &execExprString{
 		str: e.str,
+		val: NewValueString(e.str),
+		loc: e.loc,
 	}
 	return ret, nil
 }
@@ -499,6 +623,26 @@ func (e *astExprNumber) analyzeExpr(symtab *symTab) (execExpression, error) {
 	return e.analyze(symtab)
 }
 
+// integer
+type astExprInt struct {
+	num int64
+}
+
+func (e *astExprInt) dump(indent int) {
+	fmt.Printf("%d", e.num)
+}
+
+func (e *astExprInt) analyze(symtab *symTab) (*execExprInt, error) {
+	ret := &execExprInt{
+		num: e.num,
+	}
+	return ret, nil
+}
+
+func (e *astExprInt) analyzeExpr(symtab *symTab) (execExpression, error) {
+	return e.analyze(symtab)
+}
+
 // func call
 type astExprFuncCall struct {
 	fun  astExpression
@@ -536,21 +680,20 @@ func (e *astExprFuncCall) dump(indent int) {
 func (e *astExprFuncCall) analyzeAssignment(symtab *symTab) (execExpression, error) {
 	switch lval := e.args[0].(type) {
 	case *astExprIdent:
-		env_e, env_i := symtab.getVar(lval.name)
-		if env_e < 0 {
-			return nil, newParserError(&e.loc, fmt.Sprintf("unknown variable: '%s'", lval.name))
+		ret := &execExprVarAssignment{
+			name: lval.name,
+			loc:  e.loc,
+		}
+		if !symtab.resolve(lval.name, &ret.ref) {
+			return nil, newUndeclaredError(symtab, lval.name, &lval.loc, fmt.Sprintf("unknown variable: '%s'", lval.name))
 		}
 
 		val, err := e.args[1].analyzeExpr(symtab)
 		if err != nil {
 			return nil, err
 		}
-		ret := &execExprVarAssignment{
-			env_e: env_e,
-			env_i: env_i,
-			val:   val,
-			loc:   e.loc,
-		}
+		nameFuncDef(val, lval.name)
+		ret.val = val
 		return ret, nil
 
 	case *astExprElementIndex:
@@ -574,28 +717,116 @@ func (e *astExprFuncCall) analyzeAssignment(symtab *symTab) (execExpression, err
 		}
 		return ret, nil
 
+	case *astExprFuncCall:
+		if obj_expr, name, ok := lval.getDot(); ok {
+			obj, err := obj_expr.analyzeExpr(symtab)
+			if err != nil {
+				return nil, err
+			}
+			val, err := e.args[1].analyzeExpr(symtab)
+			if err != nil {
+				return nil, err
+			}
+			ret := &execExprDotSet{
+				obj:  obj,
+				name: name,
+				val:  val,
+				loc:  e.loc,
+			}
+			return ret, nil
+		}
+		return nil, newParseError(ParseErrorAssignment, &e.loc, "assignment to invalid expression")
+
 	default:
-		return nil, newParserError(&e.loc, "assignment to invalid expression")
+		return nil, newParseError(ParseErrorAssignment, &e.loc, "assignment to invalid expression")
 	}
 }
 
-func (e *astExprFuncCall) analyzeDot(symtab *symTab) (execExpression, error) {
+// check if this is a call to a binary operator
+func (e *astExprFuncCall) isOperator(name string) bool {
+	fun_op, ok := e.fun.(*astExprIdent)
+	return ok && fun_op.name == name && len(e.args) == 2
+}
+
+// returns the object expression and field name if this is 'obj.name'
+func (e *astExprFuncCall) getDot() (astExpression, string, bool) {
+	if len(e.args) != 2 {
+		return nil, "", false
+	}
+	if fun_op, ok := e.fun.(*astExprIdent); !ok || fun_op.name != "." {
+		return nil, "", false
+	}
 	if ident, ok := e.args[1].(*astExprIdent); ok {
-		container, err := e.args[0].analyzeExpr(symtab)
+		return e.args[0], ident.name, true
+	}
+	return nil, "", false
+}
+
+func (e *astExprFuncCall) analyzeDot(symtab *symTab) (execExpression, error) {
+	if obj_expr, name, ok := e.getDot(); ok {
+		obj, err := obj_expr.analyzeExpr(symtab)
 		if err != nil {
 			return nil, err
 		}
-		index := &execExprString{ident.name}
-
-		ret := &execExprElementIndex{
-			container: container,
-			index:     index,
-			loc:       e.loc,
+		ret := &execExprDot{
+			obj:  obj,
+			name: name,
+			key:  NewValueString(name),
+			loc:  e.loc,
 		}
 		return ret, nil
 	}
 
-	return nil, newParserError(&e.loc, "expected identifier after '.'")
+	return nil, newParseError(ParseErrorSyntax, &e.loc, "expected identifier after '.'")
+}
+
+// the right side of '&&' and '||' is only evaluated if needed
+func (e *astExprFuncCall) analyzeLogical(symtab *symTab, op string) (execExpression, error) {
+	left, err := e.args[0].analyzeExpr(symtab)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.args[1].analyzeExpr(symtab)
+	if err != nil {
+		return nil, err
+	}
+	if op == "&&" {
+		return &execExprAnd{left, right}, nil
+	}
+	return &execExprOr{left, right}, nil
+}
+
+func (e *astExprFuncCall) analyzeArgs(symtab *symTab) ([]execExpression, error) {
+	args := make([]execExpression, 0)
+	for _, ast_arg := range e.args {
+		exec_arg, err := ast_arg.analyzeExpr(symtab)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, exec_arg)
+	}
+	return args, nil
+}
+
+func (e *astExprFuncCall) analyzeMethodCall(symtab *symTab, dot *astExprFuncCall) (execExpression, error) {
+	obj_expr, name, _ := dot.getDot()
+	obj, err := obj_expr.analyzeExpr(symtab)
+	if err != nil {
+		return nil, err
+	}
+	args, err := e.analyzeArgs(symtab)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &execExprMethodCall{
+		obj:  obj,
+		name: name,
+		key:  NewValueString(name),
+		args: args,
+		loc:  e.loc,
+	}
+	return ret, nil
 }
 
 func (e *astExprFuncCall) analyzeExpr(symtab *symTab) (execExpression, error) {
@@ -608,7 +839,28 @@ func (e *astExprFuncCall) analyzeExpr(symtab *symTab) (execExpression, error) {
 
 			case ".":
 				return e.analyzeDot(symtab)
+
+			case "&&", "||":
+				return e.analyzeLogical(symtab, fun_op.name)
+			}
+		}
+	}
+
+	// !val
+	if len(e.args) == 1 {
+		if fun_op, ok := e.fun.(*astExprIdent); ok && fun_op.name == "!" {
+			val, err := e.args[0].analyzeExpr(symtab)
+			if err != nil {
+				return nil, err
 			}
+			return &execExprNot{val}, nil
+		}
+	}
+
+	// obj.name(args)
+	if dot, ok := e.fun.(*astExprFuncCall); ok {
+		if _, _, ok := dot.getDot(); ok {
+			return e.analyzeMethodCall(symtab, dot)
 		}
 	}
 
@@ -616,14 +868,9 @@ func (e *astExprFuncCall) analyzeExpr(symtab *symTab) (execExpression, error) {
 	if err != nil {
 		return nil, err
 	}
-	args := make([]execExpression, 0)
-
-	for _, ast_arg := range e.args {
-		exec_arg, err := ast_arg.analyzeExpr(symtab)
-		if err != nil {
-			return nil, err
-		}
-		args = append(args, exec_arg)
+	args, err := e.analyzeArgs(symtab)
+	if err != nil {
+		return nil, err
 	}
 
 	ret := &execExprFuncCall{
@@ -631,5 +878,10 @@ func (e *astExprFuncCall) analyzeExpr(symtab *symTab) (execExpression, error) {
 		args: args,
 		loc:  e.loc,
 	}
+	if ident, ok := fun.(*execExprIdent); ok && ident.ref.kind == varGlobal {
+		if op, ok := findBuiltinOp(ident.name, len(args)); ok {
+			return newExecExprOperator(op, ident, ret), nil
+		}
+	}
 	return ret, nil
 }
@@ -0,0 +1,65 @@
+package narfscript
+
+import (
+	"io"
+	"testing"
+)
+
+// mandelbrot.tst on each backend, and with the operators rebound to copies
+// of their built-in functions, so they're called instead of computed
+// directly
+func BenchmarkMandelbrot(b *testing.B) {
+	for _, backend := range backends {
+		for _, called := range []bool{false, true} {
+			name := backend.name
+			if called {
+				name += "-called-operators"
+			}
+			b.Run(name, func(b *testing.B) {
+				narf := NewNarf()
+				narf.SetBackend(backend.backend)
+				narf.SetOutput(io.Discard)
+				if called {
+					for name, op := range builtinBinaryOps {
+						narf.AddVar(name, NewValueNativeFunction(op.fun().fun))
+					}
+				}
+				if err := narf.Parse("../mandelbrot.tst"); err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := narf.CallFunction("main", nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// a loop reading ten locals, the access that flat frames made cheaper
+const localsScript = `function main() {
+	var a = 1; var b = 2; var c = 3; var d = 4; var e = 5;
+	var f = 6; var g = 7; var h = 8; var i = 9; var n = 0;
+	var k = 0;
+	while (k < 100000) {
+		n = n + a + b + c + d + e + f + g + h + i;
+		k = k + 1;
+	}
+	return n;
+}`
+
+func BenchmarkLocals(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			narf := parseTestScript(b, backend.backend, localsScript)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := narf.CallFunction("main", nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,527 @@
+package narfscript
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var valueType = reflect.TypeOf((*Value)(nil)).Elem()
+
+func goTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "vector"
+	case reflect.Map, reflect.Struct:
+		return "map"
+	}
+	return t.String()
+}
+
+// struct field name from the `narf:"name,omitempty"` tag, "-" skips the field
+func goFieldName(field reflect.StructField) (string, bool, bool) {
+	if field.PkgPath != "" {
+		return "", false, false
+	}
+	name := field.Name
+	omit_empty := false
+	if tag, ok := field.Tag.Lookup("narf"); ok {
+		if tag == "-" {
+			return "", false, false
+		}
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			name = parts[0]
+		}
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				omit_empty = true
+			}
+		}
+	}
+	return name, omit_empty, true
+}
+
+// --------------------------------------------------------------------------------
+// Go -> script
+
+func FromGo(x interface{}) (Value, error) {
+	conv := &goConverter{}
+	return conv.fromGo(reflect.ValueOf(x))
+}
+
+type goRef struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+// converts Go values, keeping track of references being converted to detect cycles
+type goConverter struct {
+	path map[goRef]bool
+}
+
+func (conv *goConverter) enter(ref goRef) error {
+	if conv.path == nil {
+		conv.path = make(map[goRef]bool)
+	}
+	if conv.path[ref] {
+		return fmt.Errorf("can't convert cyclic Go value of type %s", ref.typ)
+	}
+	conv.path[ref] = true
+	return nil
+}
+
+func (conv *goConverter) leave(ref goRef) {
+	delete(conv.path, ref)
+}
+
+func (conv *goConverter) fromGo(rv reflect.Value) (Value, error) {
+	if !rv.IsValid() {
+		return NewValueNull(), nil
+	}
+	if rv.Type().Implements(valueType) {
+		if (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) && rv.IsNil() {
+			return NewValueNull(), nil
+		}
+		return rv.Interface().(Value), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return NewValueBool(rv.Bool()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewValueInt(rv.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := rv.Uint(); n <= math.MaxInt64 {
+			return NewValueInt(int64(n)), nil
+		}
+		return NewValueNumber(float64(rv.Uint())), nil
+
+	case reflect.Float32, reflect.Float64:
+		return NewValueNumber(rv.Float()), nil
+
+	case reflect.String:
+		return NewValueString(rv.String()), nil
+
+	case reflect.Interface:
+		if rv.IsNil() {
+			return NewValueNull(), nil
+		}
+		return conv.fromGo(rv.Elem())
+
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return NewValueNull(), nil
+		}
+		ref := goRef{rv.Pointer(), 0, rv.Type()}
+		if err := conv.enter(ref); err != nil {
+			return nil, err
+		}
+		defer conv.leave(ref)
+		return conv.fromGo(rv.Elem())
+
+	case reflect.Slice:
+		if rv.IsNil() {
+			return NewValueNull(), nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return NewValueString(string(rv.Bytes())), nil
+		}
+		ref := goRef{rv.Pointer(), rv.Len(), rv.Type()}
+		if err := conv.enter(ref); err != nil {
+			return nil, err
+		}
+		defer conv.leave(ref)
+		return conv.fromGoList(rv)
+
+	case reflect.Array:
+		return conv.fromGoList(rv)
+
+	case reflect.Map:
+		if rv.IsNil() {
+			return NewValueNull(), nil
+		}
+		ref := goRef{rv.Pointer(), 0, rv.Type()}
+		if err := conv.enter(ref); err != nil {
+			return nil, err
+		}
+		defer conv.leave(ref)
+		return conv.fromGoMap(rv)
+
+	case reflect.Struct:
+		return conv.fromGoStruct(rv)
+
+	case reflect.Func:
+		if rv.IsNil() {
+			return NewValueNull(), nil
+		}
+		f, err := newGoFunc(rv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return NewValueNativeFunction(f.call), nil
+	}
+
+	return nil, fmt.Errorf("can't convert Go value of type %s", rv.Type())
+}
+
+func (conv *goConverter) fromGoList(rv reflect.Value) (Value, error) {
+	elements := make([]Value, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		el, err := conv.fromGo(rv.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, el)
+	}
+	return NewValueVector(elements), nil
+}
+
+func (conv *goConverter) fromGoMap(rv reflect.Value) (Value, error) {
+	elements := make([][2]Value, 0, rv.Len())
+	for _, key := range rv.MapKeys() {
+		k, err := conv.fromGo(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := conv.fromGo(rv.MapIndex(key))
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, [2]Value{k, v})
+	}
+
+	// Go maps have no order, so sort by key to make the result predictable
+	sort.SliceStable(elements, func(i, j int) bool {
+		return elements[i][0].String() < elements[j][0].String()
+	})
+	return NewValueMap(elements), nil
+}
+
+func (conv *goConverter) fromGoStruct(rv reflect.Value) (Value, error) {
+	t := rv.Type()
+	elements := make([][2]Value, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, omit_empty, ok := goFieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+		field := rv.Field(i)
+		if omit_empty && field.IsZero() {
+			continue
+		}
+		v, err := conv.fromGo(field)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, [2]Value{NewValueString(name), v})
+	}
+	return NewValueMap(elements), nil
+}
+
+// --------------------------------------------------------------------------------
+// script -> Go
+
+func ToGo(val Value) (interface{}, error) {
+	conv := &valueConverter{}
+	return conv.toGo(val)
+}
+
+// converts script values, keeping track of containers being converted to detect cycles
+type valueConverter struct {
+	path map[Value]bool
+}
+
+func (conv *valueConverter) enter(val Value) error {
+	if conv.path == nil {
+		conv.path = make(map[Value]bool)
+	}
+	if conv.path[val] {
+		return fmt.Errorf("can't convert cyclic %s", val.Type())
+	}
+	conv.path[val] = true
+	return nil
+}
+
+func (conv *valueConverter) leave(val Value) {
+	delete(conv.path, val)
+}
+
+func (conv *valueConverter) toGo(val Value) (interface{}, error) {
+	switch v := val.(type) {
+	case nil, *ValueNull:
+		return nil, nil
+
+	case *ValueBool:
+		return v.val, nil
+
+	case *ValueInt:
+		return v.num, nil
+
+	case ValueNumeric:
+		return v.Number(), nil
+
+	case *ValueString:
+		return v.str, nil
+
+	case *ValueVector:
+		if err := conv.enter(v); err != nil {
+			return nil, err
+		}
+		defer conv.leave(v)
+		ret := make([]interface{}, 0, len(v.elements))
+		for _, el := range v.elements {
+			x, err := conv.toGo(el)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, x)
+		}
+		return ret, nil
+
+	case *ValueMap:
+		if err := conv.enter(v); err != nil {
+			return nil, err
+		}
+		defer conv.leave(v)
+
+		// use string keys when possible
+		string_keys := true
+		for _, el := range v.elements {
+			if _, ok := el[0].(*ValueString); !ok {
+				string_keys = false
+				break
+			}
+		}
+		if string_keys {
+			ret := make(map[string]interface{}, len(v.elements))
+			for _, el := range v.elements {
+				x, err := conv.toGo(el[1])
+				if err != nil {
+					return nil, err
+				}
+				ret[el[0].(*ValueString).str] = x
+			}
+			return ret, nil
+		}
+
+		ret := make(map[interface{}]interface{}, len(v.elements))
+		for _, el := range v.elements {
+			k, err := conv.toGo(el[0])
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, fmt.Errorf("can't convert map key of type '%s'", el[0].Type())
+			}
+			x, err := conv.toGo(el[1])
+			if err != nil {
+				return nil, err
+			}
+			ret[k] = x
+		}
+		return ret, nil
+	}
+
+	return nil, fmt.Errorf("can't convert value of type '%s' to Go", val.Type())
+}
+
+// convert a script value to a Go value of type t
+func (conv *valueConverter) toGoType(val Value, t reflect.Type) (reflect.Value, error) {
+	ret := reflect.New(t).Elem()
+	if val == nil {
+		val = NewValueNull()
+	}
+	if t.Kind() != reflect.Interface || t.NumMethod() != 0 {
+		if reflect.TypeOf(val).AssignableTo(t) {
+			ret.Set(reflect.ValueOf(val))
+			return ret, nil
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, ok := val.(*ValueBool); ok {
+			ret.SetBool(b.val)
+			return ret, nil
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if n, ok := val.(ValueNumeric); ok {
+			ret.SetFloat(n.Number())
+			return ret, nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := val.(*ValueInt); ok {
+			if ret.OverflowInt(n.num) {
+				return ret, fmt.Errorf("number %d doesn't fit in %s", n.num, t)
+			}
+			ret.SetInt(n.num)
+			return ret, nil
+		}
+		if n, ok := val.(ValueNumeric); ok {
+			f := n.Number()
+			if f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 || ret.OverflowInt(int64(f)) {
+				return ret, fmt.Errorf("number %g doesn't fit in %s", f, t)
+			}
+			ret.SetInt(int64(f))
+			return ret, nil
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := val.(*ValueInt); ok {
+			if n.num < 0 || ret.OverflowUint(uint64(n.num)) {
+				return ret, fmt.Errorf("number %d doesn't fit in %s", n.num, t)
+			}
+			ret.SetUint(uint64(n.num))
+			return ret, nil
+		}
+		if n, ok := val.(ValueNumeric); ok {
+			f := n.Number()
+			if f != math.Trunc(f) || f < 0 || f >= 1<<64 || ret.OverflowUint(uint64(f)) {
+				return ret, fmt.Errorf("number %g doesn't fit in %s", f, t)
+			}
+			ret.SetUint(uint64(f))
+			return ret, nil
+		}
+
+	case reflect.String:
+		if s, ok := val.(*ValueString); ok {
+			ret.SetString(s.str)
+			return ret, nil
+		}
+
+	case reflect.Interface:
+		// natural Go representation for interface{}
+		if t.NumMethod() == 0 {
+			x, err := conv.toGo(val)
+			if err != nil {
+				return ret, err
+			}
+			if x != nil {
+				ret.Set(reflect.ValueOf(x))
+			}
+			return ret, nil
+		}
+
+	case reflect.Ptr:
+		if _, ok := val.(*ValueNull); ok {
+			return ret, nil
+		}
+		el, err := conv.toGoType(val, t.Elem())
+		if err != nil {
+			return ret, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(el)
+		return ptr, nil
+
+	case reflect.Slice:
+		if _, ok := val.(*ValueNull); ok {
+			return ret, nil
+		}
+		if s, ok := val.(*ValueString); ok && t.Elem().Kind() == reflect.Uint8 {
+			ret.SetBytes([]byte(s.str))
+			return ret, nil
+		}
+		if vec, ok := val.(*ValueVector); ok {
+			if err := conv.enter(vec); err != nil {
+				return ret, err
+			}
+			defer conv.leave(vec)
+			ret.Set(reflect.MakeSlice(t, len(vec.elements), len(vec.elements)))
+			for i, el := range vec.elements {
+				x, err := conv.toGoType(el, t.Elem())
+				if err != nil {
+					return ret, fmt.Errorf("element %d: %s", i, err)
+				}
+				ret.Index(i).Set(x)
+			}
+			return ret, nil
+		}
+
+	case reflect.Array:
+		if vec, ok := val.(*ValueVector); ok {
+			if len(vec.elements) != t.Len() {
+				return ret, fmt.Errorf("expected vector of %d elements, got %d", t.Len(), len(vec.elements))
+			}
+			if err := conv.enter(vec); err != nil {
+				return ret, err
+			}
+			defer conv.leave(vec)
+			for i, el := range vec.elements {
+				x, err := conv.toGoType(el, t.Elem())
+				if err != nil {
+					return ret, fmt.Errorf("element %d: %s", i, err)
+				}
+				ret.Index(i).Set(x)
+			}
+			return ret, nil
+		}
+
+	case reflect.Map:
+		if _, ok := val.(*ValueNull); ok {
+			return ret, nil
+		}
+		if m, ok := val.(*ValueMap); ok {
+			if err := conv.enter(m); err != nil {
+				return ret, err
+			}
+			defer conv.leave(m)
+			ret.Set(reflect.MakeMapWithSize(t, len(m.elements)))
+			for _, el := range m.elements {
+				k, err := conv.toGoType(el[0], t.Key())
+				if err != nil {
+					return ret, fmt.Errorf("map key: %s", err)
+				}
+				x, err := conv.toGoType(el[1], t.Elem())
+				if err != nil {
+					return ret, fmt.Errorf("map element %s: %s", el[0], err)
+				}
+				ret.SetMapIndex(k, x)
+			}
+			return ret, nil
+		}
+
+	case reflect.Struct:
+		if m, ok := val.(*ValueMap); ok {
+			if err := conv.enter(m); err != nil {
+				return ret, err
+			}
+			defer conv.leave(m)
+			for i := 0; i < t.NumField(); i++ {
+				name, _, ok := goFieldName(t.Field(i))
+				if !ok {
+					continue
+				}
+				for _, el := range m.elements {
+					if key, ok := el[0].(*ValueString); ok && key.str == name {
+						x, err := conv.toGoType(el[1], t.Field(i).Type)
+						if err != nil {
+							return ret, fmt.Errorf("field '%s': %s", name, err)
+						}
+						ret.Field(i).Set(x)
+						break
+					}
+				}
+			}
+			return ret, nil
+		}
+	}
+
+	return ret, fmt.Errorf("expected %s, got '%s'", goTypeName(t), val.Type())
+}
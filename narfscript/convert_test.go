@@ -0,0 +1,145 @@
+package narfscript
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testNode struct {
+	Name string `narf:"name"`
+	Next *testNode
+}
+
+type testTagged struct {
+	ID      int               `narf:"id"`
+	Label   string            `narf:"label,omitempty"`
+	Secret  string            `narf:"-"`
+	Plain   float64           // no tag
+	Extra   map[string]string `narf:",omitempty"`
+	private int
+}
+
+func TestFromGoCycles(t *testing.T) {
+	node := &testNode{Name: "a"}
+	node.Next = node
+	self_map := map[string]interface{}{"x": 1}
+	self_map["self"] = self_map
+	self_slice := []interface{}{1, nil}
+	self_slice[1] = self_slice
+
+	for name, x := range map[string]interface{}{
+		"pointer": node,
+		"map":     self_map,
+		"slice":   self_slice,
+	} {
+		if _, err := FromGo(x); err == nil || !strings.Contains(err.Error(), "cyclic") {
+			t.Errorf("%s: got error %v, want a cyclic value error", name, err)
+		}
+	}
+
+	// the same value reached twice is not a cycle
+	shared := &testNode{Name: "shared"}
+	val, err := FromGo([]*testNode{shared, shared})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := val.String(); strings.Count(got, "shared") != 2 {
+		t.Errorf("got %s, want the shared node twice", got)
+	}
+}
+
+func TestToGoCycles(t *testing.T) {
+	vec := NewValueVectorOf(NewValueInt(1), nil)
+	vec.elements[1] = vec
+	m := NewValueStringMap(map[string]Value{"x": NewValueInt(1)})
+	m.Put(NewValueString("self"), m)
+
+	for name, val := range map[string]Value{"vector": vec, "map": m} {
+		if _, err := ToGo(val); err == nil || !strings.Contains(err.Error(), "cyclic") {
+			t.Errorf("%s: got error %v, want a cyclic value error", name, err)
+		}
+		conv := &valueConverter{}
+		if _, err := conv.toGoType(val, reflect.TypeOf([]interface{}{})); err == nil {
+			t.Errorf("%s: converting to a slice didn't fail", name)
+		}
+	}
+}
+
+func TestFromGoNil(t *testing.T) {
+	var ptr *testNode
+	var m map[string]int
+	var s []int
+	var i interface{}
+	for name, x := range map[string]interface{}{"pointer": ptr, "map": m, "slice": s, "interface": i} {
+		val, err := FromGo(x)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if _, ok := val.(*ValueNull); !ok {
+			t.Errorf("%s: got %s, want null", name, val)
+		}
+	}
+
+	// null converts back to nil pointers and maps
+	conv := &valueConverter{}
+	for _, typ := range []reflect.Type{reflect.TypeOf(ptr), reflect.TypeOf(m), reflect.TypeOf(s)} {
+		x, err := conv.toGoType(NewValueNull(), typ)
+		if err != nil {
+			t.Errorf("%s: %v", typ, err)
+		} else if !x.IsNil() {
+			t.Errorf("%s: got %v, want nil", typ, x)
+		}
+	}
+}
+
+func TestStructTagsRoundTrip(t *testing.T) {
+	tests := []struct {
+		in   testTagged
+		keys string
+	}{
+		{testTagged{ID: 1, Label: "one", Secret: "s", Plain: 1.5, Extra: map[string]string{"a": "b"}, private: 3}, "id label Plain Extra"},
+		{testTagged{ID: 2, Plain: 2}, "id Plain"},
+	}
+	for _, test := range tests {
+		val, err := FromGo(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := val.(*ValueMap)
+		var keys []string
+		for _, el := range m.elements {
+			keys = append(keys, el[0].(*ValueString).str)
+		}
+		if strings.Join(keys, " ") != test.keys {
+			t.Errorf("%+v: got keys %v, want %s", test.in, keys, test.keys)
+		}
+
+		// fields skipped by the tag or unexported don't come back
+		conv := &valueConverter{}
+		out, err := conv.toGoType(val, reflect.TypeOf(testTagged{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.in
+		want.Secret = ""
+		want.private = 0
+		if got := out.Interface().(testTagged); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// a linked list without cycles round-trips through the pointers
+	list := &testNode{Name: "a", Next: &testNode{Name: "b"}}
+	val, err := FromGo(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := &valueConverter{}
+	out, err := conv.toGoType(val, reflect.TypeOf(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Interface().(*testNode); !reflect.DeepEqual(got, list) {
+		t.Errorf("got %+v, want %+v", got, list)
+	}
+}
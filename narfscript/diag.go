@@ -0,0 +1,244 @@
+package narfscript
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[1;31m"
+	ansiYellow = "\x1b[1;33m"
+	ansiGreen  = "\x1b[1;32m"
+	ansiCyan   = "\x1b[1;36m"
+)
+
+// Diagnostics keeps the source of parsed files to print errors with
+// excerpts of the lines they refer to
+type Diagnostics struct {
+	Color   bool // use ANSI escape sequences
+	sources map[string]*bytes.Buffer
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{
+		sources: make(map[string]*bytes.Buffer),
+	}
+}
+
+func (d *Diagnostics) AddSource(filename string, src string) {
+	d.newSource(filename).WriteString(src)
+}
+
+// the returned buffer receives the source as it's read
+func (d *Diagnostics) newSource(filename string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	d.sources[filename] = buf
+	return buf
+}
+
+func (d *Diagnostics) getLine(loc SrcLoc) (string, bool) {
+	buf, ok := d.sources[loc.Filename]
+	if !ok || loc.Line <= 0 {
+		return "", false
+	}
+	src := buf.Bytes()
+	for line := int32(1); line < loc.Line; line++ {
+		i := bytes.IndexByte(src, '\n')
+		if i < 0 {
+			return "", false
+		}
+		src = src[i+1:]
+	}
+	if i := bytes.IndexByte(src, '\n'); i >= 0 {
+		src = src[:i]
+	}
+	return strings.TrimRight(string(src), "\r"), true
+}
+
+func (d *Diagnostics) style(style, text string) string {
+	if !d.Color {
+		return text
+	}
+	return style + text + ansiReset
+}
+
+// Format returns the text Print writes for an error
+func (d *Diagnostics) Format(err error) string {
+	var b strings.Builder
+	d.Print(&b, err)
+	return b.String()
+}
+
+// Print writes an error followed by the source lines it refers to
+func (d *Diagnostics) Print(w io.Writer, err error) {
+	switch e := err.(type) {
+	case ParseErrorList:
+		for _, pe := range e {
+			d.printParseError(w, pe)
+		}
+	case *ParseError:
+		d.printParseError(w, e)
+	case *ExecError:
+		d.printExecError(w, e)
+	case *CancelError:
+		d.printMessage(w, e.loc, e.loc, SeverityError, fmt.Sprintf("execution stopped: %s", e.err))
+	default:
+		fmt.Fprintf(w, "%s\n", err)
+	}
+}
+
+func (d *Diagnostics) printParseError(w io.Writer, e *ParseError) {
+	d.printMessage(w, e.Pos, e.End, e.Severity, e.Msg)
+	if len(e.Suggestions) > 0 {
+		names := make([]string, len(e.Suggestions))
+		for i, name := range e.Suggestions {
+			names[i] = "'" + name + "'"
+		}
+		list := names[0]
+		if len(names) > 1 {
+			list = strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+		}
+		d.printNote(w, e.Pos, fmt.Sprintf("did you mean %s?", list))
+	}
+}
+
+func (d *Diagnostics) printExecError(w io.Writer, e *ExecError) {
+	d.printMessage(w, e.loc, e.loc, SeverityError, e.msg)
+	for _, frame := range e.trace {
+		fmt.Fprintf(w, "  in %s, called from %s\n", d.style(ansiBold, frame.Function), frame.Loc)
+		d.printExcerpt(w, frame.Loc, frame.Loc)
+	}
+	if e.omitted > 0 {
+		fmt.Fprintf(w, "  ... %d more\n", e.omitted)
+	}
+}
+
+func (d *Diagnostics) printMessage(w io.Writer, pos, end SrcLoc, severity Severity, msg string) {
+	sev_style := ansiRed
+	if severity == SeverityWarning {
+		sev_style = ansiYellow
+	}
+	fmt.Fprintf(w, "%s %s %s\n",
+		d.style(ansiBold, pos.String()+":"),
+		d.style(sev_style, severity.String()+":"),
+		d.style(ansiBold, msg))
+	d.printExcerpt(w, pos, end)
+}
+
+func (d *Diagnostics) printNote(w io.Writer, pos SrcLoc, msg string) {
+	gutter := strings.Repeat(" ", len(strconv.Itoa(int(pos.Line))))
+	fmt.Fprintf(w, " %s %s %s\n", gutter, d.style(ansiCyan, "="), msg)
+}
+
+// print the source lines from pos to end with carets under the text in
+// between, end being the position just after the text
+func (d *Diagnostics) printExcerpt(w io.Writer, pos, end SrcLoc) {
+	last := pos.Line
+	if end.Line > pos.Line {
+		// an end at the start of a line closes the line before it
+		last = end.Line
+		if end.Col <= 1 {
+			last--
+		}
+	}
+
+	gutter := strings.Repeat(" ", len(strconv.Itoa(int(last))))
+	bar := d.style(ansiCyan, "|")
+	for num := pos.Line; num <= last; num++ {
+		line, ok := d.getLine(SrcLoc{pos.Filename, num, 1})
+		if !ok {
+			return
+		}
+		length := int32(utf8.RuneCountInString(line))
+
+		// columns of the marked text on this line, to is exclusive
+		from, to := pos.Col, pos.Col+1
+		if num > pos.Line {
+			from = length - int32(utf8.RuneCountInString(strings.TrimLeft(line, " \t"))) + 1
+		}
+		switch {
+		case num < last || end.Line > last:
+			to = length + 1
+		case end.Line == num && end.Col > from:
+			to = min(end.Col, length+1)
+		}
+		if num == pos.Line && to <= from {
+			to = from + 1
+		}
+
+		label := strconv.Itoa(int(num))
+		label = strings.Repeat(" ", len(gutter)-len(label)) + label
+		fmt.Fprintf(w, " %s %s %s\n", d.style(ansiCyan, label), bar, line)
+		if to > from {
+			fmt.Fprintf(w, " %s %s %s%s\n", gutter, bar, indentTo(line, from), d.style(ansiGreen, marker(num == pos.Line, to-from)))
+		}
+	}
+}
+
+// spaces up to column col of a line, keeping tabs so that text below the
+// line lines up with it
+func indentTo(line string, col int32) string {
+	var indent strings.Builder
+	c := int32(1)
+	for _, ch := range line {
+		if c >= col {
+			break
+		}
+		if ch == '\t' {
+			indent.WriteRune('\t')
+		} else {
+			indent.WriteRune(' ')
+		}
+		c++
+	}
+	return indent.String()
+}
+
+// a caret at the start of the marked text, tildes under the rest of it
+func marker(first bool, width int32) string {
+	if !first {
+		return strings.Repeat("~", int(width))
+	}
+	return "^" + strings.Repeat("~", int(width-1))
+}
+
+// number of single rune insertions, deletions, substitutions and
+// transpositions of adjacent runes needed to turn one string into the other
+func editDistance(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+	dist := make([][]int, len(ra)+1)
+	for i := range dist {
+		dist[i] = make([]int, len(rb)+1)
+		dist[i][0] = i
+	}
+	for j := range dist[0] {
+		dist[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := dist[i-1][j-1] + cost
+			if dist[i-1][j]+1 < d {
+				d = dist[i-1][j] + 1
+			}
+			if dist[i][j-1]+1 < d {
+				d = dist[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && dist[i-2][j-2]+1 < d {
+				d = dist[i-2][j-2] + 1
+			}
+			dist[i][j] = d
+		}
+	}
+	return dist[len(ra)][len(rb)]
+}
@@ -0,0 +1,78 @@
+package narfscript
+
+import (
+	"testing"
+)
+
+func TestDiagnosticsFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "tab-indented line",
+			src:  "function f(x) {\n\tif (x) {\n\t\treturn x +;\n\t}\n}\n",
+			want: "test.tst:3:13: error: expected expression, found ';'\n" +
+				" 3 | \t\treturn x +;\n" +
+				"   | \t\t          ^\n",
+		},
+		{
+			name: "suggestion",
+			src:  "var count = 1;\nfunction f() {\n\treturn cuont + 1;\n}\n",
+			want: "test.tst:3:9: error: undeclared variable 'cuont'\n" +
+				" 3 | \treturn cuont + 1;\n" +
+				"   | \t       ^~~~~\n" +
+				"   = did you mean 'count'?\n",
+		},
+		{
+			name: "multi-line excerpt",
+			src:  "\n\n\n\n\n\nfunction f() {\n\treturn 1 \"multi\n\tline\n\n  string\";\n}\n",
+			want: "test.tst:8:11: error: expected operator or '(', found string\n" +
+				"  8 | \treturn 1 \"multi\n" +
+				"    | \t         ^~~~~~\n" +
+				"  9 | \tline\n" +
+				"    | \t~~~~\n" +
+				" 10 | \n" +
+				" 11 |   string\";\n" +
+				"    |   ~~~~~~~\n",
+		},
+		{
+			name: "stack trace",
+			src:  "function inner(x) {\n\treturn x[5];\n}\nfunction main() {\n\treturn inner([1]);\n}\n",
+			want: "test.tst:2:10: error: array index out of bounds: 5\n" +
+				" 2 | \treturn x[5];\n" +
+				"   | \t        ^\n" +
+				"  in inner, called from test.tst:5:9\n" +
+				" 5 | \treturn inner([1]);\n" +
+				"   | \t       ^\n" +
+				"  in main, called from <native>\n",
+		},
+	}
+	for _, test := range tests {
+		narf := NewNarf()
+		err := narf.ParseString("test.tst", test.src)
+		if err == nil {
+			_, err = narf.CallFunction("main", nil)
+		}
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+		if got := narf.Diagnostics().Format(err); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+
+	// colors only change the styling
+	diag := NewDiagnostics()
+	diag.Color = true
+	diag.AddSource("a.tst", "x = 1;\n")
+	err := &ParseError{Pos: SrcLoc{"a.tst", 1, 1}, End: SrcLoc{"a.tst", 1, 2}, Severity: SeverityWarning, Msg: "oops"}
+	want := "\x1b[1ma.tst:1:1:\x1b[0m \x1b[1;33mwarning:\x1b[0m \x1b[1moops\x1b[0m\n" +
+		" \x1b[1;36m1\x1b[0m \x1b[1;36m|\x1b[0m x = 1;\n" +
+		"   \x1b[1;36m|\x1b[0m \x1b[1;32m^\x1b[0m\n"
+	if got := diag.Format(err); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
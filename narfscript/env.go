@@ -1,15 +1,127 @@
 package narfscript
 
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+)
+
+// the global env holds global variables; function calls run in a frame
+// whose parent is the global env, holding the local variables and the
+// cells of variables shared with closures
 type Env struct {
 	parent *Env
 	vals   []Value
+	cells  []*valueCell
+	run    *runState
+}
+
+type valueCell struct {
+	val Value
+}
+
+type varKind uint8
+
+const (
+	varGlobal varKind = iota // global env value
+	varLocal                 // frame value
+	varCell                  // frame cell
+)
+
+// location of a variable at run time
+type varRef struct {
+	kind  varKind
+	index int
 }
 
 func newEnv(parent *Env, size int) *Env {
-	return &Env{
+	env := &Env{
 		parent: parent,
 		vals:   make([]Value, size),
 	}
+	if parent != nil {
+		env.run = parent.run
+	}
+	return env
+}
+
+func (env *Env) Context() context.Context {
+	if env == nil || env.run == nil {
+		return context.Background()
+	}
+	return env.run.ctx
+}
+
+func (env *Env) Output() io.Writer {
+	if env == nil || env.run == nil {
+		return os.Stdout
+	}
+	return env.run.stdout
+}
+
+func (env *Env) ErrorOutput() io.Writer {
+	if env == nil || env.run == nil {
+		return os.Stderr
+	}
+	return env.run.stderr
+}
+
+// reader for os.Stdin shared by all instances that don't set their own
+// input, so that input buffered by one read isn't lost to the next
+var stdin = bufio.NewReader(os.Stdin)
+
+func (env *Env) Input() *bufio.Reader {
+	if env == nil || env.run == nil {
+		return stdin
+	}
+	return env.run.stdin
+}
+
+// the global env of a frame
+func (env *Env) globals() *Env {
+	if env.parent != nil {
+		return env.parent
+	}
+	return env
+}
+
+func (env *Env) load(ref varRef) Value {
+	switch ref.kind {
+	case varLocal:
+		return env.vals[ref.index]
+	case varCell:
+		if cell := env.cells[ref.index]; cell != nil {
+			return cell.val
+		}
+		return nil
+	}
+	return env.globals().get(0, ref.index)
+}
+
+func (env *Env) store(ref varRef, val Value) bool {
+	switch ref.kind {
+	case varLocal:
+		env.vals[ref.index] = val
+		return true
+	case varCell:
+		if cell := env.cells[ref.index]; cell != nil {
+			cell.val = val
+			return true
+		}
+		return false
+	}
+	return env.globals().set(0, ref.index, val)
+}
+
+// store a newly declared variable; captured variables get a new cell, so
+// closures created before keep the old one
+func (env *Env) declare(ref varRef, val Value) {
+	if ref.kind == varCell {
+		env.cells[ref.index] = &valueCell{val}
+	} else {
+		env.store(ref, val)
+	}
 }
 
 func (env *Env) size() int {
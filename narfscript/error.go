@@ -2,9 +2,10 @@ package narfscript
 
 import (
 	"fmt"
+	"strings"
 )
 
-var theBreakError breakError = breakError{}
+const maxStackFrames = 50
 
 // --------------------------------------------------------
 // tokenizerError
@@ -17,44 +18,190 @@ func (e *tokenizerError) Error() string {
 }
 
 // --------------------------------------------------------
-// parserError
-type parserError struct {
-	msg      string
-	filename string
-	loc      SrcLoc
+// ParseError
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
 }
 
-func (e *parserError) Error() string {
-	return fmt.Sprintf("%s:%d:%d: %s", e.loc.Filename, e.loc.Line, e.loc.Col, e.msg)
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
 }
 
-func newParserError(loc *SrcLoc, msg string) *parserError {
-	return &parserError{
-		msg: msg,
-		loc: *loc,
+type ParseErrorCode int
+
+const (
+	ParseErrorSyntax ParseErrorCode = iota
+	ParseErrorToken
+	ParseErrorInclude
+	ParseErrorUndeclared
+	ParseErrorAssignment
+	ParseErrorBreak
+	ParseErrorInternal
+	LintUnusedVar
+	LintUnusedParam
+	LintShadowed
+	LintUnreachable
+	LintAssignInCondition
+	LintArity
+)
+
+var parseErrorCodeNames = []string{
+	ParseErrorSyntax:     "syntax",
+	ParseErrorToken:      "token",
+	ParseErrorInclude:    "include",
+	ParseErrorUndeclared: "undeclared",
+	ParseErrorAssignment: "assignment",
+	ParseErrorBreak:      "break",
+	ParseErrorInternal:   "internal",
+
+	LintUnusedVar:         "unused-var",
+	LintUnusedParam:       "unused-param",
+	LintShadowed:          "shadowed",
+	LintUnreachable:       "unreachable",
+	LintAssignInCondition: "assign-in-condition",
+	LintArity:             "arity",
+}
+
+func (c ParseErrorCode) String() string {
+	if c >= 0 && int(c) < len(parseErrorCodeNames) {
+		return parseErrorCodeNames[c]
+	}
+	return fmt.Sprintf("code(%d)", int(c))
+}
+
+func (c ParseErrorCode) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+type ParseError struct {
+	Pos         SrcLoc         `json:"pos"`
+	End         SrcLoc         `json:"end"` // end of the offending text, same as Pos if unknown
+	Severity    Severity       `json:"severity"`
+	Code        ParseErrorCode `json:"code"`
+	Msg         string         `json:"message"`
+	Suggestions []string       `json:"suggestions,omitempty"` // names that could have been meant, best first
+}
+
+func (e *ParseError) Error() string {
+	if e.Severity != SeverityError {
+		return fmt.Sprintf("%s: %s: %s", e.Pos, e.Severity, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func newParseError(code ParseErrorCode, loc *SrcLoc, msg string) *ParseError {
+	return &ParseError{
+		Pos:      *loc,
+		End:      *loc,
+		Severity: SeverityError,
+		Code:     code,
+		Msg:      msg,
+	}
+}
+
+func newParseErrorFromTok(code ParseErrorCode, tok *token, msg string) *ParseError {
+	return &ParseError{
+		Pos:      tok.loc,
+		End:      tok.end,
+		Severity: SeverityError,
+		Code:     code,
+		Msg:      msg,
+	}
+}
+
+// all errors found in a script, in the order they were found
+type ParseErrorList []*ParseError
+
+func (l ParseErrorList) Error() string {
+	if len(l) == 0 {
+		return "no errors"
+	}
+	lines := make([]string, len(l))
+	for i, e := range l {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// return the list as an error, or nil if it's empty
+func (l ParseErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
 	}
+	return l
 }
 
-func newParserErrorFromTok(tok *token, msg string) *parserError {
-	return &parserError{
-		msg: msg,
-		loc: tok.loc,
+func (l *ParseErrorList) add(err error) {
+	switch e := err.(type) {
+	case ParseErrorList:
+		*l = append(*l, e...)
+	case *ParseError:
+		*l = append(*l, e)
+	default:
+		*l = append(*l, &ParseError{
+			Severity: SeverityError,
+			Code:     ParseErrorInternal,
+			Msg:      err.Error(),
+		})
 	}
 }
 
 // --------------------------------------------------------
 // ExecError
+type ExecErrorKind int
+
+const (
+	ExecErrorRuntime ExecErrorKind = iota
+	ExecErrorException
+	ExecErrorStepLimit
+	ExecErrorCallDepthLimit
+	ExecErrorElementLimit
+	ExecErrorStringLimit
+)
+
+type StackFrame struct {
+	Function string
+	Loc      SrcLoc // where the function was called from
+}
+
 type ExecError struct {
-	msg string
-	val Value
-	loc SrcLoc
+	kind    ExecErrorKind
+	msg     string
+	val     Value
+	loc     SrcLoc
+	trace   []StackFrame
+	omitted int
+	owner   *runState // call adding frames to this error
 }
 
 func newExecError(loc *SrcLoc, msg string) *ExecError {
 	return &ExecError{
-		msg: msg,
-		val: nil,
-		loc: *loc,
+		kind: ExecErrorRuntime,
+		msg:  msg,
+		val:  nil,
+		loc:  *loc,
+	}
+}
+
+func newExecLimitError(loc *SrcLoc, kind ExecErrorKind, msg string) *ExecError {
+	return &ExecError{
+		kind: kind,
+		msg:  msg,
+		loc:  *loc,
 	}
 }
 
@@ -66,14 +213,58 @@ func newExecException(loc *SrcLoc, val Value) *ExecError {
 		msg = "exception"
 	}
 	return &ExecError{
-		msg: msg,
-		val: val,
-		loc: *loc,
+		kind: ExecErrorException,
+		msg:  msg,
+		val:  val,
+		loc:  *loc,
 	}
 }
 
 func (e *ExecError) Error() string {
-	return fmt.Sprintf("%s:%d:%d: %s", e.loc.Filename, e.loc.Line, e.loc.Col, e.msg)
+	if len(e.trace) == 0 {
+		return fmt.Sprintf("%s: %s", e.loc, e.msg)
+	}
+	lines := make([]string, 0, len(e.trace)+2)
+	lines = append(lines, fmt.Sprintf("%s: %s", e.loc, e.msg))
+	for _, frame := range e.trace {
+		lines = append(lines, fmt.Sprintf("  in %s, called from %s", frame.Function, frame.Loc))
+	}
+	if e.omitted > 0 {
+		lines = append(lines, fmt.Sprintf("  ... %d more", e.omitted))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add a frame while the error propagates out of a function call; only
+// the innermost frames are kept. Errors from other calls, like a value
+// saved and returned again by a native function, are copied first, so
+// they don't change.
+func (e *ExecError) withFrame(function string, loc *SrcLoc, run *runState) *ExecError {
+	if run == nil || e.owner != run {
+		clone := *e
+		clone.trace = append([]StackFrame(nil), e.trace...)
+		clone.owner = run
+		e = &clone
+	}
+	if len(e.trace) >= maxStackFrames {
+		e.omitted++
+		return e
+	}
+	e.trace = append(e.trace, StackFrame{function, *loc})
+	return e
+}
+
+// call frames from the innermost function outwards
+func (e *ExecError) StackTrace() []StackFrame {
+	return e.trace
+}
+
+func (e *ExecError) Kind() ExecErrorKind {
+	return e.kind
+}
+
+func (e *ExecError) Loc() SrcLoc {
+	return e.loc
 }
 
 func (e *ExecError) Value() Value {
@@ -84,29 +275,27 @@ func (e *ExecError) Value() Value {
 }
 
 // --------------------------------------------------------
-// Return
-type returnError struct {
-	retval Value
-}
-
-func (e *returnError) Error() string {
-	return fmt.Sprintf("<return %s>", e.retval)
+// CancelError
+type CancelError struct {
+	err error
+	loc SrcLoc
 }
 
-func newReturnError(retval Value) *returnError {
-	return &returnError{retval}
+func newCancelError(loc *SrcLoc, err error) *CancelError {
+	return &CancelError{
+		err: err,
+		loc: *loc,
+	}
 }
 
-// --------------------------------------------------------
-// Break
-type breakError struct {
-	retval Value
+func (e *CancelError) Error() string {
+	return fmt.Sprintf("%s: execution stopped: %s", e.loc, e.err)
 }
 
-func (e *breakError) Error() string {
-	return "<break>"
+func (e *CancelError) Unwrap() error {
+	return e.err
 }
 
-func newBreakError() *breakError {
-	return &theBreakError
+func (e *CancelError) Loc() SrcLoc {
+	return e.loc
 }
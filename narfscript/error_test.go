@@ -0,0 +1,56 @@
+package narfscript
+
+import (
+	"testing"
+)
+
+func TestStackTrace(t *testing.T) {
+	src := `function inner() { error("oops"); }
+function outer() { inner(); }
+function main() { outer(); }`
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, src)
+		_, err := narf.CallFunction("main", nil)
+		exec_err, ok := err.(*ExecError)
+		if !ok {
+			t.Fatalf("[%s]: got error %v", b.name, err)
+		}
+		var names []string
+		for _, frame := range exec_err.StackTrace() {
+			names = append(names, frame.Function)
+		}
+		if len(names) != 3 || names[0] != "inner" || names[1] != "outer" || names[2] != "main" {
+			t.Errorf("[%s]: got frames %v", b.name, names)
+		}
+	}
+}
+
+// an error saved by the host and returned again by a native function
+// gets its own frames on each call
+func TestStackTraceOfReturnedError(t *testing.T) {
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, "function fail() { error(\"saved\"); }")
+		_, err := narf.CallFunction("fail", nil)
+		saved, ok := err.(*ExecError)
+		if !ok || len(saved.StackTrace()) != 1 {
+			t.Fatalf("[%s]: got error %v", b.name, err)
+		}
+
+		narf.AddVar("native", NewValueNativeFunction(func(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+			return nil, saved
+		}))
+		if err := narf.ParseString("main.tst", "function f() { native(); } function main() { f(); }"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			_, err := narf.CallFunction("main", nil)
+			exec_err, ok := err.(*ExecError)
+			if !ok || len(exec_err.StackTrace()) != 3 {
+				t.Fatalf("[%s]: got error %v", b.name, err)
+			}
+		}
+		if n := len(saved.StackTrace()); n != 1 {
+			t.Errorf("[%s]: saved error has %d frames, want 1", b.name, n)
+		}
+	}
+}
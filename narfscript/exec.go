@@ -2,11 +2,22 @@ package narfscript
 
 import (
 	"fmt"
+	"sync"
+)
+
+// how a statement finished running; the statements around it use the
+// status to stop running the block, the loop or the function
+type execStatus uint8
+
+const (
+	execNormal execStatus = iota
+	execReturn            // the value is the return value
+	execBreak
 )
 
 type execStatement interface {
 	dump(int)
-	exec(env *Env) error
+	exec(env *Env) (execStatus, Value, error)
 }
 
 type execExpression interface {
@@ -16,35 +27,67 @@ type execExpression interface {
 
 // func def
 type execExprFuncDef struct {
+	name       string
+	params     []string
 	num_params int
+	param_refs []varRef
+	num_slots  int
+	num_cells  int
+	captures   []varRef // cells of the enclosing frame used by the function
 	body       *execStmtBlock
+	code       *vmCode
+	code_once  sync.Once
 }
 
 func (e *execExprFuncDef) dump(indent int) {
 	fmt.Printf("function(")
-	for i := 0; i < e.num_params; i++ {
+	for i, p := range e.params {
 		if i > 0 {
 			fmt.Printf(", ")
 		}
-		fmt.Printf("<0:%d>", i)
+		fmt.Printf("%s", p)
 	}
 	fmt.Printf(") ")
 	e.body.dump(indent)
-	fmt.Printf("\n")
 }
 
 func (e *execExprFuncDef) eval(env *Env) (Value, error) {
+	env.run.count()
+	return newClosure(e, env), nil
+}
+
+func newClosure(def *execExprFuncDef, env *Env) *ValueClosure {
 	ret := &ValueClosure{
-		fun: e,
-		env: env,
+		fun: def,
+		env: env.globals(),
 	}
-	return ret, nil
+	if len(def.captures) > 0 {
+		ret.cells = make([]*valueCell, len(def.captures))
+		for i, ref := range def.captures {
+			ret.cells[i] = env.cells[ref.index]
+		}
+	}
+	return ret
+}
+
+// run the body in an env holding the arguments
+func (e *execExprFuncDef) call(env *Env) (Value, error) {
+	if env.run.useVM() {
+		return e.bytecode().run(env)
+	}
+	status, retval, err := e.body.exec(env)
+	if err != nil {
+		return nil, err
+	}
+	if status == execReturn {
+		return retval, nil
+	}
+	return NewValueNull(), nil
 }
 
 // block
 type execStmtBlock struct {
-	var_value execExpression
-	stmts     []execStatement
+	stmts []execStatement
 }
 
 func (e *execStmtBlock) dump(indent int) {
@@ -57,23 +100,38 @@ func (e *execStmtBlock) dump(indent int) {
 	fmt.Printf("}\n")
 }
 
-func (e *execStmtBlock) exec(env *Env) error {
-	if e.var_value != nil {
-		val, err := e.var_value.eval(env)
-		if err != nil {
-			return err
-		}
-		new_env := newEnv(env, 1)
-		new_env.set(0, 0, val)
-		env = new_env
-	}
+func (e *execStmtBlock) exec(env *Env) (execStatus, Value, error) {
+	env.run.count()
 	for _, s := range e.stmts {
-		err := s.exec(env)
-		if err != nil {
-			return err
+		status, val, err := s.exec(env)
+		if status != execNormal || err != nil {
+			return status, val, err
 		}
 	}
-	return nil
+	return execNormal, nil, nil
+}
+
+// var
+type execStmtVar struct {
+	name string
+	ref  varRef
+	val  execExpression
+}
+
+func (e *execStmtVar) dump(indent int) {
+	fmt.Printf("var %s = ", e.name)
+	e.val.dump(indent)
+	fmt.Printf(";\n")
+}
+
+func (e *execStmtVar) exec(env *Env) (execStatus, Value, error) {
+	env.run.count()
+	val, err := e.val.eval(env)
+	if err != nil {
+		return execNormal, nil, err
+	}
+	env.declare(e.ref, val)
+	return execNormal, nil, nil
 }
 
 // if
@@ -110,10 +168,11 @@ func (e *execStmtIf) dump(indent int) {
 	}
 }
 
-func (e *execStmtIf) exec(env *Env) error {
+func (e *execStmtIf) exec(env *Env) (execStatus, Value, error) {
+	env.run.count()
 	test_val, err := e.test_expr.eval(env)
 	if err != nil {
-		return err
+		return execNormal, nil, err
 	}
 	if valueIsTrue(test_val) {
 		return e.true_stmt.exec(env)
@@ -121,13 +180,14 @@ func (e *execStmtIf) exec(env *Env) error {
 	if e.false_stmt != nil {
 		return e.false_stmt.exec(env)
 	}
-	return nil
+	return execNormal, nil, nil
 }
 
 // while
 type execStmtWhile struct {
 	test_expr execExpression
 	stmt      execStatement
+	loc       SrcLoc
 }
 
 func (e *execStmtWhile) dump(indent int) {
@@ -144,24 +204,55 @@ func (e *execStmtWhile) dump(indent int) {
 	}
 }
 
-func (e *execStmtWhile) exec(env *Env) error {
+func (e *execStmtWhile) exec(env *Env) (execStatus, Value, error) {
 	for {
+		if err := env.run.step(&e.loc); err != nil {
+			return execNormal, nil, err
+		}
 		test_val, err := e.test_expr.eval(env)
 		if err != nil {
-			return err
+			return execNormal, nil, err
 		}
 		if !valueIsTrue(test_val) {
 			break
 		}
-		err = e.stmt.exec(env)
-		if err != nil {
-			if _, ok := err.(*breakError); ok {
-				break
-			}
-			return err
+		status, val, err := e.stmt.exec(env)
+		if err != nil || status == execReturn {
+			return status, val, err
+		}
+		if status == execBreak {
+			break
 		}
 	}
-	return nil
+	return execNormal, nil, nil
+}
+
+// 'if' or 'while' whose condition the optimizer has computed: the
+// branch selected by the condition runs while the globals it was computed
+// from keep their values, the whole statement once one of them changes
+type execStmtFolded struct {
+	guards []execGuard
+	stmt   execStatement // nil if the condition selects nothing to run
+	orig   execStatement
+}
+
+func (e *execStmtFolded) dump(indent int) {
+	if e.stmt == nil {
+		fmt.Printf("{}\n")
+		return
+	}
+	e.stmt.dump(indent)
+}
+
+func (e *execStmtFolded) exec(env *Env) (execStatus, Value, error) {
+	if !guardsHold(e.guards, env) {
+		return e.orig.exec(env)
+	}
+	env.run.count()
+	if e.stmt == nil {
+		return execNormal, nil, nil
+	}
+	return e.stmt.exec(env)
 }
 
 // return
@@ -178,12 +269,16 @@ func (e *execStmtReturn) dump(indent int) {
 	fmt.Printf(";\n")
 }
 
-func (e *execStmtReturn) exec(env *Env) error {
+func (e *execStmtReturn) exec(env *Env) (execStatus, Value, error) {
+	env.run.count()
+	if e.retval == nil {
+		return execReturn, NewValueNull(), nil
+	}
 	retval, err := e.retval.eval(env)
 	if err != nil {
-		return err
+		return execNormal, nil, err
 	}
-	return newReturnError(retval)
+	return execReturn, retval, nil
 }
 
 // break
@@ -194,8 +289,9 @@ func (e *execStmtBreak) dump(indent int) {
 	fmt.Printf("break;\n")
 }
 
-func (e *execStmtBreak) exec(env *Env) error {
-	return newBreakError()
+func (e *execStmtBreak) exec(env *Env) (execStatus, Value, error) {
+	env.run.count()
+	return execBreak, nil, nil
 }
 
 // statement expression
@@ -208,14 +304,16 @@ func (e *execStmtExpression) dump(indent int) {
 	fmt.Printf(";\n")
 }
 
-func (e *execStmtExpression) exec(env *Env) error {
+func (e *execStmtExpression) exec(env *Env) (execStatus, Value, error) {
+	env.run.count()
 	_, err := e.e.eval(env)
-	return err
+	return execNormal, nil, err
 }
 
 // map literal
 type execExprMapLiteral struct {
 	elements [][2]execExpression
+	loc      SrcLoc
 }
 
 func (e *execExprMapLiteral) dump(indent int) {
@@ -232,6 +330,12 @@ func (e *execExprMapLiteral) dump(indent int) {
 }
 
 func (e *execExprMapLiteral) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
+	if err := env.run.checkElements("map", len(e.elements), &e.loc); err != nil {
+		return nil, err
+	}
 	elements := make([][2]Value, 0, len(e.elements))
 	for _, exec_el := range e.elements {
 		val_key, err := exec_el[0].eval(env)
@@ -244,15 +348,13 @@ func (e *execExprMapLiteral) eval(env *Env) (Value, error) {
 		}
 		elements = append(elements, [2]Value{val_key, val_val})
 	}
-	ret := &ValueMap{
-		elements: elements,
-	}
-	return ret, nil
+	return NewValueMap(elements), nil
 }
 
 // vector literal
 type execExprVectorLiteral struct {
 	elements []execExpression
+	loc      SrcLoc
 }
 
 func (e *execExprVectorLiteral) dump(indent int) {
@@ -267,6 +369,12 @@ func (e *execExprVectorLiteral) dump(indent int) {
 }
 
 func (e *execExprVectorLiteral) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
+	if err := env.run.checkElements("vector", len(e.elements), &e.loc); err != nil {
+		return nil, err
+	}
 	elements := make([]Value, 0, len(e.elements))
 	for _, exec_el := range e.elements {
 		val_el, err := exec_el.eval(env)
@@ -296,6 +404,9 @@ func (e *execExprElementIndex) dump(indent int) {
 }
 
 func (e *execExprElementIndex) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
 	container, err := e.container.eval(env)
 	if err != nil {
 		return nil, err
@@ -313,19 +424,22 @@ func (e *execExprElementIndex) eval(env *Env) (Value, error) {
 
 // ident
 type execExprIdent struct {
-	env_index int
-	var_index int
-	loc       SrcLoc
+	name string
+	ref  varRef
+	loc  SrcLoc
 }
 
 func (e *execExprIdent) dump(indent int) {
-	fmt.Printf("<%d:%d>", e.env_index, e.var_index)
+	fmt.Printf("%s", e.name)
 }
 
 func (e *execExprIdent) eval(env *Env) (Value, error) {
-	val := env.get(e.env_index, e.var_index)
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
+	val := env.load(e.ref)
 	if val == nil {
-		return nil, newExecError(&e.loc, fmt.Sprintf("undefined variable <%d:%d>", e.env_index, e.var_index))
+		return nil, newExecError(&e.loc, fmt.Sprintf("variable '%s' is not initialized yet", e.name))
 	}
 	return val, nil
 }
@@ -333,6 +447,8 @@ func (e *execExprIdent) eval(env *Env) (Value, error) {
 // string
 type execExprString struct {
 	str string
+	val *ValueString
+	loc SrcLoc
 }
 
 func (e *execExprString) dump(indent int) {
@@ -340,8 +456,13 @@ func (e *execExprString) dump(indent int) {
 }
 
 func (e *execExprString) eval(env *Env) (Value, error) {
-	ret := &ValueString{e.str}
-	return ret, nil
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
+	if err := env.run.checkString(len(e.str), &e.loc); err != nil {
+		return nil, err
+	}
+	return e.val, nil
 }
 
 // number
@@ -354,32 +475,181 @@ func (e *execExprNumber) dump(indent int) {
 }
 
 func (e *execExprNumber) eval(env *Env) (Value, error) {
+	env.run.count()
 	ret := &ValueNumber{e.num}
 	return ret, nil
 }
 
+// integer
+type execExprInt struct {
+	num int64
+}
+
+func (e *execExprInt) dump(indent int) {
+	fmt.Printf("%d", e.num)
+}
+
+func (e *execExprInt) eval(env *Env) (Value, error) {
+	env.run.count()
+	return NewValueInt(e.num), nil
+}
+
+// constant
+type execExprConst struct {
+	val Value
+}
+
+func (e *execExprConst) dump(indent int) {
+	fmt.Printf("%s", e.val)
+}
+
+func (e *execExprConst) eval(env *Env) (Value, error) {
+	env.run.count()
+	return e.val, nil
+}
+
+// a global that must still hold val for a folded value to be used
+type execGuard struct {
+	ref varRef
+	val Value
+}
+
+// value computed by the optimizer from literals and predefined globals
+type execExprFolded struct {
+	val    Value
+	guards []execGuard
+	expr   execExpression // evaluated instead once a global has changed
+}
+
+func (e *execExprFolded) dump(indent int) {
+	fmt.Printf("%s", e.val)
+}
+
+func (e *execExprFolded) holds(env *Env) bool {
+	return guardsHold(e.guards, env)
+}
+
+func guardsHold(guards []execGuard, env *Env) bool {
+	for _, g := range guards {
+		if env.load(g.ref) != g.val {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *execExprFolded) eval(env *Env) (Value, error) {
+	env.run.count()
+	if !e.holds(env) {
+		return e.expr.eval(env)
+	}
+	return e.val, nil
+}
+
+// logical and
+type execExprAnd struct {
+	left  execExpression
+	right execExpression
+}
+
+func (e *execExprAnd) dump(indent int) {
+	fmt.Printf("(")
+	e.left.dump(indent)
+	fmt.Printf(" && ")
+	e.right.dump(indent)
+	fmt.Printf(")")
+}
+
+func (e *execExprAnd) eval(env *Env) (Value, error) {
+	env.run.count()
+	left, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if !valueIsTrue(left) {
+		return NewValueBool(false), nil
+	}
+	right, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return NewValueBool(valueIsTrue(right)), nil
+}
+
+// logical or
+type execExprOr struct {
+	left  execExpression
+	right execExpression
+}
+
+func (e *execExprOr) dump(indent int) {
+	fmt.Printf("(")
+	e.left.dump(indent)
+	fmt.Printf(" || ")
+	e.right.dump(indent)
+	fmt.Printf(")")
+}
+
+func (e *execExprOr) eval(env *Env) (Value, error) {
+	env.run.count()
+	left, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if valueIsTrue(left) {
+		return NewValueBool(true), nil
+	}
+	right, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return NewValueBool(valueIsTrue(right)), nil
+}
+
+// logical not
+type execExprNot struct {
+	val execExpression
+}
+
+func (e *execExprNot) dump(indent int) {
+	fmt.Printf("!")
+	e.val.dump(indent)
+}
+
+func (e *execExprNot) eval(env *Env) (Value, error) {
+	env.run.count()
+	val, err := e.val.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return NewValueBool(!valueIsTrue(val)), nil
+}
+
 // var assignment
 type execExprVarAssignment struct {
-	env_e int
-	env_i int
-	val   execExpression
-	loc   SrcLoc
+	name string
+	ref  varRef
+	val  execExpression
+	loc  SrcLoc
 }
 
 func (e *execExprVarAssignment) dump(indent int) {
-	fmt.Printf("<%d:%d> = ", e.env_e, e.env_i)
+	fmt.Printf("%s = ", e.name)
 	e.val.dump(indent)
 	fmt.Printf(";")
 }
 
 func (e *execExprVarAssignment) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
 	val, err := e.val.eval(env)
 	if err != nil {
 		return nil, err
 	}
 
-	if !env.set(e.env_e, e.env_i, val) {
-		return nil, newParserError(&e.loc, "unknown variable in assignment")
+	if !env.store(e.ref, val) {
+		return nil, newExecError(&e.loc, fmt.Sprintf("unknown variable '%s' in assignment", e.name))
 	}
 
 	return val, nil
@@ -403,6 +673,9 @@ func (e *execExprContainerSet) dump(indent int) {
 }
 
 func (e *execExprContainerSet) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
 	container, err := e.container.eval(env)
 	if err != nil {
 		return nil, err
@@ -416,14 +689,16 @@ func (e *execExprContainerSet) eval(env *Env) (Value, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = c.Set(index, val, &e.loc)
-		if err != nil {
+		if err := env.run.checkSetIndex(container, index, &e.loc); err != nil {
+			return nil, err
+		}
+		if err := c.Set(index, val, &e.loc); err != nil {
 			return nil, err
 		}
 		return val, nil
 	}
 
-	return nil, newParserError(&e.loc, fmt.Sprintf("trying to set value of non-container object of type '%s'", container.Type()))
+	return nil, newExecError(&e.loc, fmt.Sprintf("trying to set value of non-container object of type '%s'", container.Type()))
 }
 
 // func call
@@ -446,6 +721,10 @@ func (e *execExprFuncCall) dump(indent int) {
 }
 
 func (e *execExprFuncCall) eval(env *Env) (Value, error) {
+	if err := env.run.step(&e.loc); err != nil {
+		return nil, err
+	}
+
 	// evaluate function value
 	fun_val, err := e.fun.eval(env)
 	if err != nil {
@@ -457,15 +736,237 @@ func (e *execExprFuncCall) eval(env *Env) (Value, error) {
 	}
 
 	// evaluate argument values
-	args := make([]Value, 0, len(e.args))
-	for _, arg := range e.args {
+	args, err := evalArgs(e.args, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// call function
+	ret, err := fun.Call(args, env, &e.loc)
+	if err != nil {
+		return nil, err
+	}
+	if err := env.run.checkSize(ret, &e.loc); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func evalArgs(exprs []execExpression, env *Env) ([]Value, error) {
+	args := make([]Value, 0, len(exprs))
+	for _, arg := range exprs {
 		arg_val, err := arg.eval(env)
 		if err != nil {
 			return nil, err
 		}
 		args = append(args, arg_val)
 	}
+	return args, nil
+}
 
-	// call function
-	return fun.Call(args, env, &e.loc)
+// built-in operator, computed directly while its variable still holds the
+// built-in function and called like any other function once the script
+// has rebound it
+type execExprOperator struct {
+	op    builtinOp
+	fun   *ValueNativeFunction
+	ident *execExprIdent
+	call  *execExprFuncCall
+}
+
+func newExecExprOperator(op builtinOp, ident *execExprIdent, call *execExprFuncCall) *execExprOperator {
+	return &execExprOperator{
+		op:    op,
+		fun:   op.fun(),
+		ident: ident,
+		call:  call,
+	}
+}
+
+func (e *execExprOperator) dump(indent int) {
+	e.call.dump(indent)
+}
+
+func (e *execExprOperator) isBuiltin(env *Env) bool {
+	fun, ok := env.load(e.ident.ref).(*ValueNativeFunction)
+	return ok && fun == e.fun
+}
+
+func (e *execExprOperator) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.call.loc); err != nil {
+		return nil, err
+	}
+	if !e.isBuiltin(env) {
+		return e.call.eval(env)
+	}
+
+	x, err := e.call.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	var y Value
+	if len(e.call.args) > 1 {
+		y, err = e.call.args[1].eval(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.op.apply(x, y, &e.call.loc)
+}
+
+// field access
+type execExprDot struct {
+	obj  execExpression
+	name string
+	key  *ValueString
+	loc  SrcLoc
+}
+
+func (e *execExprDot) dump(indent int) {
+	e.obj.dump(indent)
+	fmt.Printf(".%s", e.name)
+}
+
+func getField(obj Value, name string, key *ValueString, loc *SrcLoc) (Value, error) {
+	switch o := obj.(type) {
+	case ValueObject:
+		if method, ok := o.Method(name); ok {
+			bound := func(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+				return method(o, args, env, loc)
+			}
+			return NewValueNativeFunction(bound), nil
+		}
+		return o.GetField(name, loc)
+
+	case ValueContainer:
+		return o.Get(key, loc)
+	}
+	return nil, newExecError(loc, fmt.Sprintf("trying to get field '%s' of value of type '%s'", name, obj.Type()))
+}
+
+func (e *execExprDot) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
+	obj, err := e.obj.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return getField(obj, e.name, e.key, &e.loc)
+}
+
+// field assignment
+type execExprDotSet struct {
+	obj  execExpression
+	name string
+	val  execExpression
+	loc  SrcLoc
+}
+
+func (e *execExprDotSet) dump(indent int) {
+	e.obj.dump(indent)
+	fmt.Printf(".%s = ", e.name)
+	e.val.dump(indent)
+	fmt.Printf(";")
+}
+
+func (e *execExprDotSet) eval(env *Env) (Value, error) {
+	if err := env.run.node(&e.loc); err != nil {
+		return nil, err
+	}
+	obj, err := e.obj.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	val, err := e.val.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o := obj.(type) {
+	case ValueObject:
+		err = o.SetField(e.name, val, &e.loc)
+
+	case ValueContainer:
+		key := NewValueString(e.name)
+		err = env.run.checkSetIndex(obj, key, &e.loc)
+		if err == nil {
+			err = o.Set(key, val, &e.loc)
+		}
+
+	default:
+		err = newExecError(&e.loc, fmt.Sprintf("trying to set field '%s' of value of type '%s'", e.name, obj.Type()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// method call
+type execExprMethodCall struct {
+	obj  execExpression
+	name string
+	key  *ValueString
+	args []execExpression
+	loc  SrcLoc
+}
+
+func (e *execExprMethodCall) dump(indent int) {
+	e.obj.dump(indent)
+	fmt.Printf(".%s(", e.name)
+	for i, a := range e.args {
+		if i > 0 {
+			fmt.Printf(", ")
+		}
+		a.dump(indent)
+	}
+	fmt.Printf(")")
+}
+
+func (e *execExprMethodCall) eval(env *Env) (Value, error) {
+	if err := env.run.step(&e.loc); err != nil {
+		return nil, err
+	}
+
+	obj, err := e.obj.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// methods get the object as receiver, functions stored in fields are called as they are
+	var method NativeMethod
+	var fun ValueCallable
+	if o, ok := obj.(ValueObject); ok {
+		method, _ = o.Method(e.name)
+	}
+	if method == nil {
+		fun_val, err := getField(obj, e.name, e.key, &e.loc)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := fun_val.(ValueCallable)
+		if !ok {
+			return nil, newExecError(&e.loc, fmt.Sprintf("trying to call non-function value of type '%s'", fun_val.Type()))
+		}
+		fun = f
+	}
+
+	args, err := evalArgs(e.args, env)
+	if err != nil {
+		return nil, err
+	}
+	var ret Value
+	if method != nil {
+		ret, err = method(obj.(ValueObject), args, env, &e.loc)
+	} else {
+		ret, err = fun.Call(args, env, &e.loc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := env.run.checkSize(ret, &e.loc); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
@@ -0,0 +1,117 @@
+package narfscript
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Go function called through reflection
+type goFunc struct {
+	fn         reflect.Value
+	params     []reflect.Type
+	variadic   bool
+	use_ctx    bool
+	has_result bool
+	has_error  bool
+}
+
+func newGoFunc(fn interface{}) (*goFunc, error) {
+	fn_val := reflect.ValueOf(fn)
+	if fn_val.Kind() != reflect.Func || fn_val.IsNil() {
+		return nil, fmt.Errorf("expected function, got %T", fn)
+	}
+	fn_type := fn_val.Type()
+
+	f := &goFunc{
+		fn:       fn_val,
+		variadic: fn_type.IsVariadic(),
+	}
+
+	// parameters, with an optional leading context
+	for i := 0; i < fn_type.NumIn(); i++ {
+		if i == 0 && fn_type.In(i) == contextType {
+			f.use_ctx = true
+			continue
+		}
+		f.params = append(f.params, fn_type.In(i))
+	}
+
+	// results: [value] [error]
+	switch fn_type.NumOut() {
+	case 0:
+	case 1:
+		if fn_type.Out(0) == errorType {
+			f.has_error = true
+		} else {
+			f.has_result = true
+		}
+	case 2:
+		if fn_type.Out(1) != errorType {
+			return nil, fmt.Errorf("second result of %s must be error", fn_type)
+		}
+		f.has_result = true
+		f.has_error = true
+	default:
+		return nil, fmt.Errorf("too many results in %s", fn_type)
+	}
+	return f, nil
+}
+
+func (f *goFunc) call(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	// check number of arguments
+	num_fixed := len(f.params)
+	if f.variadic {
+		num_fixed--
+		if len(args) < num_fixed {
+			return nil, newExecError(loc,
+				fmt.Sprintf("invalid number of arguments: expected at least %d, got %d", num_fixed, len(args)))
+		}
+	} else if len(args) != num_fixed {
+		return nil, newExecError(loc,
+			fmt.Sprintf("invalid number of arguments: expected %d, got %d", num_fixed, len(args)))
+	}
+
+	// convert arguments
+	in := make([]reflect.Value, 0, len(args)+1)
+	if f.use_ctx {
+		in = append(in, reflect.ValueOf(env.Context()))
+	}
+	for i, arg := range args {
+		var param_type reflect.Type
+		if i >= num_fixed {
+			param_type = f.params[num_fixed].Elem()
+		} else {
+			param_type = f.params[i]
+		}
+		conv := &valueConverter{}
+		in_val, err := conv.toGoType(arg, param_type)
+		if err != nil {
+			return nil, newExecError(loc, fmt.Sprintf("argument %d: %s", i+1, err))
+		}
+		in = append(in, in_val)
+	}
+
+	// call and convert results
+	out := f.fn.Call(in)
+	if f.has_error {
+		if err, ok := out[len(out)-1].Interface().(error); ok && err != nil {
+			if exec_err, ok := err.(*ExecError); ok {
+				return nil, exec_err
+			}
+			return nil, newExecError(loc, err.Error())
+		}
+	}
+	if !f.has_result {
+		return NewValueNull(), nil
+	}
+	conv := &goConverter{}
+	ret, err := conv.fromGo(out[0])
+	if err != nil {
+		return nil, newExecError(loc, err.Error())
+	}
+	return ret, nil
+}
@@ -0,0 +1,79 @@
+package narfscript
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGoFuncCalls(t *testing.T) {
+	funcs := map[string]interface{}{
+		"add":  func(a, b int) int { return a + b },
+		"join": func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"check": func(n int) (int, error) {
+			if n < 0 {
+				return 0, errors.New("negative number")
+			}
+			return n, nil
+		},
+		"fail":   func() error { return errors.New("failed") },
+		"any":    func(x interface{}) bool { return x == nil },
+		"nilptr": func(p *int) bool { return p == nil },
+		"name":   func(s string) string { return s },
+	}
+	tests := []struct {
+		call string
+		args []Value
+		want string
+		err  string
+	}{
+		{"add(1, 2)", nil, "3", ""},
+		{"add(1)", nil, "", "invalid number of arguments: expected 2, got 1"},
+		{"add(1, 2, 3)", nil, "", "invalid number of arguments: expected 2, got 3"},
+		{"add(1, \"two\")", nil, "", "argument 2: expected number, got 'string'"},
+		{"add(1.5, 2)", nil, "", "argument 1: number 1.5 doesn't fit in int"},
+		{"join(\"-\")", nil, `""`, ""},
+		{"join(\"-\", \"a\", \"b\", \"c\")", nil, `"a-b-c"`, ""},
+		{"join()", nil, "", "invalid number of arguments: expected at least 1, got 0"},
+		{"join(\"-\", \"a\", 2)", nil, "", "argument 3: expected string, got 'int'"},
+		{"check(5)", nil, "5", ""},
+		{"check(-5)", nil, "", "negative number"},
+		{"fail()", nil, "", "failed"},
+
+		// nil elements of host containers are passed as null
+		{"any(x[0])", []Value{NewValueVectorOf(nil)}, "true", ""},
+		{"nilptr(x[0])", []Value{NewValueVectorOf(nil)}, "true", ""},
+		{"name(x[0])", []Value{NewValueVectorOf(nil)}, "", "argument 1: expected string, got 'null'"},
+	}
+
+	for _, b := range backends {
+		for _, test := range tests {
+			narf := NewNarf()
+			narf.SetBackend(b.backend)
+			for name, fn := range funcs {
+				if err := narf.AddGoFunc(name, fn); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := narf.ParseString("test.tst", "function main(x) { return "+test.call+"; }"); err != nil {
+				t.Fatal(err)
+			}
+			args := test.args
+			if args == nil {
+				args = []Value{NewValueNull()}
+			}
+			ret, err := narf.CallFunction("main", args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("%s [%s]: got error %v, want %q", test.call, b.name, err, test.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s [%s]: %v", test.call, b.name, err)
+			} else if ret.String() != test.want {
+				t.Errorf("%s [%s]: got %s, want %s", test.call, b.name, ret, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package narfscript
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type lintVar struct {
+	name     string
+	loc      SrcLoc
+	param    bool
+	fun      bool
+	used     bool
+	assigned bool
+}
+
+type lintScope struct {
+	parent *lintScope
+	vars   map[string]*lintVar
+	local  bool
+}
+
+type linter struct {
+	scope    *lintScope
+	funcs    map[string]*astExprFuncDef
+	loops    int
+	warnings ParseErrorList
+}
+
+// Lint checks the parsed scripts for mistakes that are not errors:
+// variables and parameters that are never read, shadowed names, unreachable code,
+// 'break' outside loops, assignments used as 'if' conditions and calls
+// to script functions with the wrong number of arguments
+func (bleep *Narf) Lint() ParseErrorList {
+	l := &linter{
+		scope:    &lintScope{vars: make(map[string]*lintVar)},
+		funcs:    make(map[string]*astExprFuncDef),
+		warnings: make(ParseErrorList, 0),
+	}
+
+	// script globals are visible everywhere; predefined names are not checked
+	for _, script := range bleep.scripts {
+		for _, f := range script.funcs {
+			l.scope.vars[f.name] = &lintVar{name: f.name, loc: f.loc, fun: true}
+			l.funcs[f.name] = f.def
+		}
+		for _, v := range script.vars {
+			l.scope.vars[v.ident] = &lintVar{name: v.ident, loc: v.loc}
+			delete(l.funcs, v.ident)
+		}
+		for _, s := range script.stmts {
+			if v, ok := s.(*astStmtVar); ok {
+				l.scope.vars[v.ident] = &lintVar{name: v.ident, loc: v.loc}
+				delete(l.funcs, v.ident)
+			}
+		}
+	}
+
+	for _, script := range bleep.scripts {
+		for _, f := range script.funcs {
+			l.lintFunc(f.def)
+		}
+		for _, v := range script.vars {
+			if v.val != nil {
+				l.lintExpr(v.val)
+			}
+		}
+		l.lintStmts(script.stmts)
+	}
+
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		a, b := l.warnings[i].Pos, l.warnings[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return l.warnings
+}
+
+func (l *linter) warn(severity Severity, code ParseErrorCode, loc SrcLoc, width int, msg string) {
+	err := newParseError(code, &loc, msg)
+	err.Severity = severity
+	err.End.Col += int32(width)
+	l.warnings = append(l.warnings, err)
+}
+
+func (l *linter) openScope() {
+	l.scope = &lintScope{
+		parent: l.scope,
+		vars:   make(map[string]*lintVar),
+		local:  true,
+	}
+}
+
+func (l *linter) closeScope() {
+	for _, v := range l.scope.vars {
+		l.checkUsed(v)
+	}
+	l.scope = l.scope.parent
+}
+
+func (l *linter) checkUsed(v *lintVar) {
+	if v.used || strings.HasPrefix(v.name, "_") {
+		return
+	}
+	width := utf8.RuneCountInString(v.name)
+	code, kind, what := LintUnusedVar, "variable", "never used"
+	if v.param {
+		code, kind = LintUnusedParam, "parameter"
+	}
+	if v.assigned {
+		what = "assigned but never read"
+	}
+	l.warn(SeverityWarning, code, v.loc, width, fmt.Sprintf("%s '%s' is %s", kind, v.name, what))
+}
+
+func (l *linter) declare(name string, loc SrcLoc, param bool) {
+	width := utf8.RuneCountInString(name)
+	if old, ok := l.scope.vars[name]; ok {
+		l.checkUsed(old)
+		l.warn(SeverityWarning, LintShadowed, loc, width, fmt.Sprintf("'%s' redeclares the variable declared at %s", name, old.loc))
+	} else if old, _ := l.lookup(name); old != nil {
+		kind := "variable"
+		if old.fun {
+			kind = "function"
+		}
+		l.warn(SeverityWarning, LintShadowed, loc, width, fmt.Sprintf("'%s' shadows the %s declared at %s", name, kind, old.loc))
+	}
+	l.scope.vars[name] = &lintVar{
+		name:  name,
+		loc:   loc,
+		param: param,
+	}
+}
+
+func (l *linter) lookup(name string) (*lintVar, *lintScope) {
+	for scope := l.scope; scope != nil; scope = scope.parent {
+		if v, ok := scope.vars[name]; ok {
+			return v, scope
+		}
+	}
+	return nil, nil
+}
+
+func (l *linter) lintFunc(def *astExprFuncDef) {
+	loops := l.loops
+	l.loops = 0
+	l.openScope()
+	for i, param := range def.params {
+		l.declare(param, def.param_locs[i], true)
+	}
+	l.lintStmt(def.body)
+	l.closeScope()
+	l.loops = loops
+}
+
+func (l *linter) lintStmts(stmts []astStatement) {
+	terminated := false
+	for _, s := range stmts {
+		if terminated {
+			if block, ok := s.(*astStmtBlock); !ok || len(block.stmts) > 0 {
+				l.warn(SeverityWarning, LintUnreachable, stmtLoc(s), 0, "unreachable code")
+			}
+			terminated = false
+		}
+		l.lintStmt(s)
+		if stmtTerminates(s) {
+			terminated = true
+		}
+	}
+}
+
+func (l *linter) lintStmt(stmt astStatement) {
+	switch s := stmt.(type) {
+	case *astStmtBlock:
+		l.openScope()
+		l.lintStmts(s.stmts)
+		l.closeScope()
+
+	case *astStmtVar:
+		if s.val != nil {
+			l.lintExpr(s.val)
+		}
+		// top level 'var' statements in script mode assign to globals
+		if l.scope.local {
+			l.declare(s.ident, s.loc, false)
+		}
+
+	case *astStmtIf:
+		if call, ok := s.test_expr.(*astExprFuncCall); ok && call.isOperator("=") {
+			l.warn(SeverityWarning, LintAssignInCondition, call.loc, 1, "assignment used as condition, did you mean '=='?")
+		}
+		l.lintExpr(s.test_expr)
+		l.lintStmt(s.true_stmt)
+		if s.false_stmt != nil {
+			l.lintStmt(s.false_stmt)
+		}
+
+	case *astStmtWhile:
+		l.lintExpr(s.test_expr)
+		l.loops++
+		l.lintStmt(s.stmt)
+		l.loops--
+
+	case *astStmtReturn:
+		if s.retval != nil {
+			l.lintExpr(s.retval)
+		}
+
+	case *astStmtBreak:
+		if l.loops == 0 {
+			l.warn(SeverityError, ParseErrorBreak, s.loc, 5, "'break' outside of a loop")
+		}
+
+	case *astStmtExpression:
+		l.lintExpr(s.e)
+	}
+}
+
+func (l *linter) lintExpr(expr astExpression) {
+	switch e := expr.(type) {
+	case *astExprIdent:
+		if v, _ := l.lookup(e.name); v != nil {
+			v.used = true
+		}
+
+	case *astExprFuncCall:
+		l.lintCall(e)
+
+	case *astExprElementIndex:
+		l.lintExpr(e.container)
+		l.lintExpr(e.index)
+
+	case *astExprMapLiteral:
+		for _, el := range e.elements {
+			l.lintExpr(el[1])
+		}
+
+	case *astExprVectorLiteral:
+		for _, el := range e.elements {
+			l.lintExpr(el)
+		}
+
+	case *astExprFuncDef:
+		l.lintFunc(e)
+	}
+}
+
+func (l *linter) lintCall(e *astExprFuncCall) {
+	// assigning to a variable is not a use
+	if e.isOperator("=") {
+		if ident, ok := e.args[0].(*astExprIdent); ok {
+			if v, _ := l.lookup(ident.name); v != nil {
+				v.assigned = true
+			}
+		} else {
+			l.lintExpr(e.args[0])
+		}
+		l.lintExpr(e.args[1])
+		return
+	}
+
+	// the field name in 'obj.name' is not a variable
+	if obj, _, ok := e.getDot(); ok {
+		l.lintExpr(obj)
+		return
+	}
+
+	if ident, ok := e.fun.(*astExprIdent); ok {
+		_, scope := l.lookup(ident.name)
+		if def, ok := l.funcs[ident.name]; ok && scope != nil && !scope.local && len(def.params) != len(e.args) {
+			l.warn(SeverityWarning, LintArity, e.loc, utf8.RuneCountInString(ident.name),
+				fmt.Sprintf("function '%s' takes %d arguments, called with %d", ident.name, len(def.params), len(e.args)))
+		}
+	}
+	l.lintExpr(e.fun)
+	for _, arg := range e.args {
+		l.lintExpr(arg)
+	}
+}
+
+// check if nothing after the statement can run
+func stmtTerminates(stmt astStatement) bool {
+	switch s := stmt.(type) {
+	case *astStmtReturn, *astStmtBreak:
+		return true
+	case *astStmtBlock:
+		for _, sub := range s.stmts {
+			if stmtTerminates(sub) {
+				return true
+			}
+		}
+	case *astStmtIf:
+		return s.false_stmt != nil && stmtTerminates(s.true_stmt) && stmtTerminates(s.false_stmt)
+	}
+	return false
+}
+
+func stmtLoc(stmt astStatement) SrcLoc {
+	switch s := stmt.(type) {
+	case *astStmtBlock:
+		return s.loc
+	case *astStmtVar:
+		return s.loc
+	case *astStmtIf:
+		return s.loc
+	case *astStmtWhile:
+		return s.loc
+	case *astStmtReturn:
+		return s.loc
+	case *astStmtBreak:
+		return s.loc
+	case *astStmtExpression:
+		return s.loc
+	}
+	return SrcLoc{}
+}
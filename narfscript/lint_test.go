@@ -0,0 +1,62 @@
+package narfscript
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func lintTestScript(t *testing.T, src string) ParseErrorList {
+	t.Helper()
+	narf := NewNarf()
+	if err := narf.ParseString("test.tst", src); err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return narf.Lint()
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"function f(a, b) { return a; }", []string{"1:15 unused-param: parameter 'b' is never used"}},
+		{"function f(_a) { return 1; }", nil},
+		{"function f() { var x = 1; return 2; }", []string{"1:20 unused-var: variable 'x' is never used"}},
+		{"function f(x) { var y = 0; y = x; }", []string{"1:21 unused-var: variable 'y' is assigned but never read"}},
+		{"function f(a) { if (a = 2) { return 1; a = 3; } }", []string{
+			"1:12 unused-param: parameter 'a' is assigned but never read",
+			"1:23 assign-in-condition: assignment used as condition, did you mean '=='?",
+			"1:40 unreachable: unreachable code",
+		}},
+		{"function f(a) { if (a == 2) { return 1; } return a; }", nil},
+		{"function f() { return 1; print(2); }", []string{"1:26 unreachable: unreachable code"}},
+		{"function f(x) { if (x) { return 1; } else { return 2; } x = 3; }", []string{"1:57 unreachable: unreachable code"}},
+		{"function g() { } function f(g) { return g; }", []string{"1:29 shadowed: 'g' shadows the function declared at test.tst:1:10"}},
+		{"var n = 1; function f() { var n = 2; return n; }", []string{"1:31 shadowed: 'n' shadows the variable declared at test.tst:1:5"}},
+		{"function g(x) { return x; } function f() { return g(1, 2); }", []string{"1:51 arity: function 'g' takes 1 arguments, called with 2"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, w := range lintTestScript(t, test.src) {
+			got = append(got, fmt.Sprintf("%d:%d %s: %s", w.Pos.Line, w.Pos.Col, w.Code, w.Msg))
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", test.src, got, test.want)
+		}
+	}
+}
+
+func TestLintJSON(t *testing.T) {
+	warnings := lintTestScript(t, "function f(a) {\n\treturn 1;\n}\n")
+	out, err := json.Marshal(warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"pos":{"file":"test.tst","line":1,"col":12},"end":{"file":"test.tst","line":1,"col":13},` +
+		`"severity":"warning","code":"unused-param","message":"parameter 'a' is never used"}]`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+
+}
@@ -1,7 +1,11 @@
 package narfscript
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
+	"strings"
 )
 
 func makeMap(els []string) map[string]bool {
@@ -13,10 +17,15 @@ func makeMap(els []string) map[string]bool {
 }
 
 type Narf struct {
-	symtab *symTab
-	env    *Env
-	parser *bleepParser
-	funcs  map[string]*astNamedFuncDef
+	symtab    *symTab
+	env       *Env
+	parser    *bleepParser
+	funcs     map[string]*astNamedFuncDef
+	scripts   []*astScript
+	defs      []*programFunc
+	parse_err error
+	diag      *Diagnostics
+	inst      *Instance
 }
 
 func NewNarf() *Narf {
@@ -66,7 +75,11 @@ func NewNarf() *Narf {
 		env:    newEnv(nil, 0),
 		parser: newParser(keywords, operators, elIndexPrec, funCallPrec),
 		funcs:  make(map[string]*astNamedFuncDef, 0),
+		defs:   make([]*programFunc, 0),
+		diag:   NewDiagnostics(),
 	}
+	bleep.parser.diag = bleep.diag
+	bleep.inst = newInstance(bleep.symtab, bleep.env, Limits{})
 	bleep.setup()
 	return bleep
 }
@@ -80,24 +93,77 @@ func (bleep *Narf) setup() {
 	bleep.AddVar("null", NewValueNull())
 	bleep.AddVar("false", NewValueBool(false))
 	bleep.AddVar("true", NewValueBool(true))
-	bleep.AddVar("==", NewValueNativeFunction(nativeEquals))
-	bleep.AddVar("!=", NewValueNativeFunction(nativeNotEquals))
-	bleep.AddVar("+", NewValueNativeFunction(nativeAdd))
-	bleep.AddVar("-", NewValueNativeFunction(nativeSub))
-	bleep.AddVar("*", NewValueNativeFunction(nativeMul))
-	bleep.AddVar("/", NewValueNativeFunction(nativeDiv))
-	bleep.AddVar("%", NewValueNativeFunction(nativeMod))
-	bleep.AddVar("^", NewValueNativeFunction(nativePow))
-	bleep.AddVar("<", NewValueNativeFunction(nativeLess))
-	bleep.AddVar(">", NewValueNativeFunction(nativeGreater))
-	bleep.AddVar("<=", NewValueNativeFunction(nativeLessEqual))
-	bleep.AddVar(">=", NewValueNativeFunction(nativeGreaterEqual))
+	bleep.AddVar("==", opEquals.fun())
+	bleep.AddVar("!=", opNotEquals.fun())
+	bleep.AddVar("+", opAdd.fun())
+	bleep.AddVar("-", opSub.fun())
+	bleep.AddVar("*", opMul.fun())
+	bleep.AddVar("/", opDiv.fun())
+	bleep.AddVar("%", opMod.fun())
+	bleep.AddVar("^", opPow.fun())
+	bleep.AddVar("<", opLess.fun())
+	bleep.AddVar(">", opGreater.fun())
+	bleep.AddVar("<=", opLessEqual.fun())
+	bleep.AddVar(">=", opGreaterEqual.fun())
+	bleep.AddVar("int", NewValueNativeFunction(nativeInt))
+	bleep.AddVar("float", NewValueNativeFunction(nativeFloat))
+	bleep.AddVar("div", NewValueNativeFunction(nativeDivInt))
+	bleep.AddVar("bit_and", NewValueNativeFunction(nativeBitAnd))
+	bleep.AddVar("bit_or", NewValueNativeFunction(nativeBitOr))
+	bleep.AddVar("bit_xor", NewValueNativeFunction(nativeBitXor))
+	bleep.AddVar("bit_not", NewValueNativeFunction(nativeBitNot))
+	bleep.AddVar("shift_left", NewValueNativeFunction(nativeShiftLeft))
+	bleep.AddVar("shift_right", NewValueNativeFunction(nativeShiftRight))
 	bleep.AddVar("error", NewValueNativeFunction(nativeError))
 	bleep.AddVar("printf", NewValueNativeFunction(nativePrintf))
+	bleep.AddVar("print", NewValueNativeFunction(nativePrint))
+	bleep.AddVar("println", NewValueNativeFunction(nativePrintln))
+	bleep.AddVar("eprint", NewValueNativeFunction(nativeErrorPrint))
+	bleep.AddVar("eprintln", NewValueNativeFunction(nativeErrorPrintln))
+	bleep.AddVar("readline", NewValueNativeFunction(nativeReadLine))
+	bleep.AddVar("read_all", NewValueNativeFunction(nativeReadAll))
+}
+
+func (bleep *Narf) SetLimits(limits Limits) {
+	bleep.inst.SetLimits(limits)
+}
+
+// selects the tree interpreter (the default) or the bytecode VM
+func (bleep *Narf) SetBackend(backend Backend) {
+	bleep.inst.SetBackend(backend)
+}
+
+// the diagnostics keep the source of all parsed files
+func (bleep *Narf) Diagnostics() *Diagnostics {
+	return bleep.diag
+}
+
+// in script mode, top level statements are allowed and executed by Run()
+func (bleep *Narf) SetScriptMode(script_mode bool) {
+	bleep.parser.script_mode = script_mode
+}
+
+func (bleep *Narf) SetOutput(w io.Writer) {
+	bleep.inst.SetOutput(w)
+}
+
+func (bleep *Narf) SetErrorOutput(w io.Writer) {
+	bleep.inst.SetErrorOutput(w)
+}
+
+func (bleep *Narf) SetInput(r io.Reader) {
+	bleep.inst.SetInput(r)
+}
+
+func (bleep *Narf) SetLocking(locking bool) {
+	bleep.inst.SetLocking(locking)
 }
 
 func (bleep *Narf) AddVar(name string, val Value) {
+	defer bleep.inst.unlock(bleep.inst.lock())
+
 	sym_index := bleep.symtab.addVar(name)
+	bleep.removeDef(sym_index)
 	if sym_index >= bleep.env.size() {
 		env_index := bleep.env.grow(val)
 		if env_index != sym_index {
@@ -108,49 +174,151 @@ func (bleep *Narf) AddVar(name string, val Value) {
 	}
 }
 
+func (bleep *Narf) AddGoFunc(name string, fn interface{}) error {
+	f, err := newGoFunc(fn)
+	if err != nil {
+		return err
+	}
+	bleep.AddVar(name, NewValueNativeFunction(f.call))
+	return nil
+}
+
 func (bleep *Narf) Parse(filename string) error {
-	funcs, err := bleep.parser.Parse(filename)
+	return bleep.ParseFS(osFS{}, filename)
+}
+
+func (bleep *Narf) ParseFS(fsys fs.FS, filename string) error {
+	script, err := bleep.parser.ParseFile(fsys, filename)
 	if err != nil {
+		bleep.parse_err = err
 		return err
 	}
+	return bleep.addScript(script)
+}
+
+// scripts read without a filesystem can't include other files
+func (bleep *Narf) ParseReader(name string, in io.Reader) error {
+	return bleep.ParseReaderFS(nil, name, in)
+}
+
+// files included by the script are read from fsys
+func (bleep *Narf) ParseReaderFS(fsys fs.FS, name string, in io.Reader) error {
+	script, err := bleep.parser.ParseReader(fsys, name, in)
+	if err != nil {
+		bleep.parse_err = err
+		return err
+	}
+	return bleep.addScript(script)
+}
 
-	for _, ast_f := range funcs {
+func (bleep *Narf) ParseString(name string, src string) error {
+	return bleep.ParseReader(name, strings.NewReader(src))
+}
+
+func (bleep *Narf) ParseStringFS(fsys fs.FS, name string, src string) error {
+	return bleep.ParseReaderFS(fsys, name, strings.NewReader(src))
+}
+
+func (bleep *Narf) addScript(script *astScript) error {
+	bleep.scripts = append(bleep.scripts, script)
+
+	// declare all globals before analyzing anything
+	for _, ast_f := range script.funcs {
 		bleep.funcs[ast_f.name] = ast_f
 		bleep.AddVar(ast_f.name, nil)
 	}
+	for _, ast_v := range script.vars {
+		bleep.AddVar(ast_v.ident, nil)
+	}
+	for _, ast_s := range script.stmts {
+		if ast_v, ok := ast_s.(*astStmtVar); ok {
+			bleep.AddVar(ast_v.ident, nil)
+		}
+	}
 
-	for _, ast_f := range funcs {
+	// keep analyzing after an error to report all errors in the script
+	var errs ParseErrorList
+	for _, ast_f := range script.funcs {
 		exec_f, err := ast_f.analyze(bleep.symtab)
 		if err != nil {
-			return err
+			errs.add(err)
+			continue
 		}
+		optimizeFunc(exec_f)
 		closure := &ValueClosure{
 			fun: exec_f,
 			env: bleep.env,
 		}
 		bleep.AddVar(ast_f.name, closure)
+		bleep.addDef(ast_f.name, exec_f)
+	}
+
+	// initializers run in an env below the globals, in source order before the next call
+	init_symtab := newSymTab(bleep.symtab, nil)
+	for _, ast_v := range script.vars {
+		val, err := ast_v.analyzeValue(init_symtab)
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		val = optimizeExpr(val)
+		_, index := bleep.symtab.getVar(ast_v.ident)
+		bleep.inst.inits = append(bleep.inst.inits, &globalInit{index, val})
+	}
+
+	if bleep.parser.script_mode {
+		entry, err := script.analyzeEntry(bleep.symtab)
+		if err != nil {
+			errs.add(err)
+		} else {
+			optimizeFunc(entry)
+			bleep.inst.entries = append(bleep.inst.entries, entry)
+		}
+	}
+
+	if len(errs) > 0 {
+		bleep.parse_err = errs
+		return errs
 	}
 	return nil
 }
 
-func (bleep *Narf) CallFunction(name string, args []Value) (Value, error) {
-	loc := &SrcLoc{"<native>", 0, 0}
-	env_index, var_index := bleep.symtab.getVar(name)
-	fun := bleep.env.get(env_index, var_index)
-	if fun == nil {
-		return nil, newExecError(loc, fmt.Sprintf("function '%s' not found", name))
-	}
-	if f, ok := fun.(ValueCallable); ok {
-		return f.Call(args, bleep.env, loc)
+func (bleep *Narf) addDef(name string, def *execExprFuncDef) {
+	_, index := bleep.symtab.getVar(name)
+	bleep.defs = append(bleep.defs, &programFunc{index, def})
+}
+
+func (bleep *Narf) removeDef(index int) {
+	for i, f := range bleep.defs {
+		if f.index == index {
+			bleep.defs = append(bleep.defs[:i], bleep.defs[i+1:]...)
+			return
+		}
 	}
-	return nil, newExecError(loc, fmt.Sprintf("trying to call non-function value of type '%s'", fun.Type()))
+}
+
+func (bleep *Narf) CallFunction(name string, args []Value) (Value, error) {
+	return bleep.inst.CallFunction(name, args)
+}
+
+func (bleep *Narf) CallFunctionContext(ctx context.Context, name string, args []Value) (Value, error) {
+	return bleep.inst.CallFunctionContext(ctx, name, args)
+}
+
+func (bleep *Narf) Run() (Value, error) {
+	return bleep.inst.Run()
+}
+
+func (bleep *Narf) RunContext(ctx context.Context) (Value, error) {
+	return bleep.inst.RunContext(ctx)
 }
 
 func (bleep *Narf) DumpFunctions() {
 	fmt.Printf("========================================\n")
-	for _, f := range bleep.funcs {
-		fmt.Printf("-> ")
-		f.dump(0)
+	for _, f := range bleep.defs {
+		fmt.Printf("-> %s = ", f.def.name)
+		f.def.dump(0)
+		fmt.Printf("\n")
 	}
 	fmt.Printf("========================================\n")
 }
@@ -0,0 +1,129 @@
+package narfscript
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseStringFSInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib.tst": {Data: []byte("function twice(x) { return 2*x; }\n")},
+	}
+	narf := NewNarf()
+	src := "include \"lib.tst\"\nfunction main() { return twice(21); }\n"
+	if err := narf.ParseStringFS(fsys, "main.tst", src); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := narf.CallFunction("main", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := AsInt(ret); n != 42 {
+		t.Errorf("got %s, want 42", ret)
+	}
+}
+
+func TestParseStringIncludeWithoutFS(t *testing.T) {
+	narf := NewNarf()
+	err := narf.ParseString("main.tst", "include \"mandelbrot.tst\"\nfunction main() {}\n")
+	list, ok := err.(ParseErrorList)
+	if !ok || len(list) != 1 || list[0].Code != ParseErrorInclude {
+		t.Fatalf("got error %v, want an include error", err)
+	}
+	if !strings.Contains(list[0].Msg, "no filesystem") {
+		t.Errorf("unexpected message: %s", list[0].Msg)
+	}
+}
+
+func TestRunReturnEndsScript(t *testing.T) {
+	for _, b := range backends {
+		narf := NewNarf()
+		narf.SetBackend(b.backend)
+		narf.SetScriptMode(true)
+		narf.AddVar("runs", NewValueInt(0))
+		scripts := []string{
+			"runs = runs + 1;",
+			"if (runs > 1) return runs;",
+			"runs = runs + 10;",
+		}
+		for i, src := range scripts {
+			if err := narf.ParseString(fmt.Sprintf("script%d.tst", i), src); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the first run goes through all scripts, the second returns from the second one
+		for _, want := range []string{"null", "12"} {
+			ret, err := narf.Run()
+			if err != nil {
+				t.Fatalf("[%s]: %v", b.name, err)
+			}
+			if ret.String() != want {
+				t.Errorf("[%s]: got %s, want %s", b.name, ret, want)
+			}
+		}
+	}
+}
+
+func TestRebindOperator(t *testing.T) {
+	src := "function mul(a, b) { return a * b; }\nfunction main() { return mul(6, 7) + 2 * 3; }\n"
+	add := NewValueNativeFunction(func(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+		a, _ := AsInt(args[0])
+		b, _ := AsInt(args[1])
+		return NewValueInt(a + b), nil
+	})
+	check := func(name string, narf *Narf, want string) {
+		t.Helper()
+		ret, err := narf.CallFunction("main", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ret.String() != want {
+			t.Errorf("%s: got %s, want %s", name, ret, want)
+		}
+	}
+
+	for _, b := range backends {
+		// '*' replaced before the script is parsed and optimized
+		narf := NewNarf()
+		narf.SetBackend(b.backend)
+		narf.AddVar("*", add)
+		if err := narf.ParseString("test.tst", src); err != nil {
+			t.Fatal(err)
+		}
+		check(fmt.Sprintf("before parse [%s]", b.name), narf, "18")
+
+		// '*' replaced after the functions have run with the built-in one
+		narf = parseTestScript(t, b.backend, src)
+		check(fmt.Sprintf("built-in [%s]", b.name), narf, "48")
+		narf.AddVar("*", add)
+		check(fmt.Sprintf("after parse [%s]", b.name), narf, "18")
+	}
+}
+
+// reads keep the buffered input between natives and calls
+func TestInput(t *testing.T) {
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, "function line() { return readline(); }\nfunction two() { return [readline(), readline()]; }\nfunction rest() { return read_all(); }")
+		narf.SetInput(strings.NewReader("one\r\ntwo\nthree\nfour\nfive"))
+		for _, test := range []struct{ fun, want string }{
+			{"two", `[ "one", "two" ]`},
+			{"line", `"three"`},
+			{"rest", `"four\nfive"`},
+			{"line", "null"},
+		} {
+			ret, err := narf.CallFunction(test.fun, nil)
+			if err != nil {
+				t.Fatalf("[%s] %s: %v", b.name, test.fun, err)
+			}
+			if ret.String() != test.want {
+				t.Errorf("[%s] %s: got %s, want %s", b.name, test.fun, ret, test.want)
+			}
+		}
+	}
+	if (*Env)(nil).Input() != (*Env)(nil).Input() {
+		t.Errorf("Input() without a running call doesn't reuse the stdin reader")
+	}
+}
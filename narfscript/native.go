@@ -2,6 +2,7 @@ package narfscript
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"strings"
 )
@@ -19,6 +20,9 @@ func valueIsTrue(val Value) bool {
 	case *ValueNumber:
 		return v.Number() != 0
 
+	case *ValueInt:
+		return v.num != 0
+
 	default:
 		return true
 	}
@@ -28,7 +32,7 @@ func valuesAreEqual(v1, v2 Value) bool {
 	// both are numeric
 	if n1, ok := v1.(ValueNumeric); ok {
 		if n2, ok := v2.(ValueNumeric); ok {
-			return n1.Number() == n2.Number()
+			return numbersAreEqual(n1, n2)
 		}
 	}
 
@@ -42,7 +46,14 @@ func valuesAreEqual(v1, v2 Value) bool {
 	return v1 == v2
 }
 
+func numbersAreEqual(n1, n2 ValueNumeric) bool {
+	return numericToOpNum(n1).equals(numericToOpNum(n2))
+}
+
 func valueToNumber(val Value, loc *SrcLoc) (float64, error) {
+	if v, ok := val.(*ValueNumber); ok {
+		return v.num, nil
+	}
 	if v, ok := val.(ValueNumeric); ok {
 		return v.Number(), nil
 	}
@@ -50,6 +61,9 @@ func valueToNumber(val Value, loc *SrcLoc) (float64, error) {
 }
 
 func valueToInt(val Value, loc *SrcLoc) (int, error) {
+	if v, ok := val.(*ValueInt); ok {
+		return int(v.num), nil
+	}
 	n, err := valueToNumber(val, loc)
 	if err != nil {
 		return 0, err
@@ -89,7 +103,7 @@ func doSprintf(args []Value, env *Env, loc *SrcLoc) ([]string, error) {
 		if active {
 			switch ch {
 			case '%':
-				fmt.Printf("%%")
+				buf = append(buf, "%")
 
 			case 's':
 				if next_arg >= len(args) {
@@ -107,11 +121,11 @@ func doSprintf(args []Value, env *Env, loc *SrcLoc) ([]string, error) {
 				if next_arg >= len(args) {
 					return nil, newExecError(loc, "not enough arguments")
 				} else {
-					num, err := valueToInt(args[next_arg], loc)
+					n, err := printfInt(args[next_arg], loc)
 					if err != nil {
 						return nil, err
 					}
-					buf = append(buf, fmt.Sprintf("%d", int64(num)))
+					buf = append(buf, fmt.Sprintf("%d", n))
 				}
 				next_arg++
 
@@ -150,12 +164,13 @@ func nativePrintf(args []Value, env *Env, loc *SrcLoc) (Value, error) {
 	}
 
 	ret_n := 0
+	out := env.Output()
 	for _, s := range buf {
-		n, _ := fmt.Printf("%s", s)
+		n, _ := io.WriteString(out, s)
 		ret_n += n
 	}
 
-	return NewValueNumber(float64(ret_n)), nil
+	return NewValueInt(int64(ret_n)), nil
 }
 
 func nativeSprintf(args []Value, env *Env, loc *SrcLoc) (Value, error) {
@@ -169,6 +184,72 @@ func nativeSprintf(args []Value, env *Env, loc *SrcLoc) (Value, error) {
 	return NewValueString(s), nil
 }
 
+// === print ===================================================
+
+func valueToPrintString(val Value) string {
+	if str, ok := val.(*ValueString); ok {
+		return str.str
+	}
+	return val.String()
+}
+
+func doPrint(out io.Writer, args []Value, end string, loc *SrcLoc) (Value, error) {
+	strs := make([]string, 0, len(args))
+	for _, arg := range args {
+		strs = append(strs, valueToPrintString(arg))
+	}
+	if _, err := io.WriteString(out, strings.Join(strs, " ")+end); err != nil {
+		return nil, newExecError(loc, err.Error())
+	}
+	return NewValueNull(), nil
+}
+
+func nativePrint(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return doPrint(env.Output(), args, "", loc)
+}
+
+func nativePrintln(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return doPrint(env.Output(), args, "\n", loc)
+}
+
+func nativeErrorPrint(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return doPrint(env.ErrorOutput(), args, "", loc)
+}
+
+func nativeErrorPrintln(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return doPrint(env.ErrorOutput(), args, "\n", loc)
+}
+
+// === input ===================================================
+
+// returns the next line without the line terminator, or null at end of input
+func nativeReadLine(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	if len(args) != 0 {
+		return nil, newExecError(loc, "no arguments expected")
+	}
+	line, err := env.Input().ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, newExecError(loc, err.Error())
+	}
+	if err == io.EOF && line == "" {
+		return NewValueNull(), nil
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return NewValueString(line), nil
+}
+
+func nativeReadAll(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	if len(args) != 0 {
+		return nil, newExecError(loc, "no arguments expected")
+	}
+	data, err := io.ReadAll(env.Input())
+	if err != nil {
+		return nil, newExecError(loc, err.Error())
+	}
+	return NewValueString(string(data)), nil
+}
+
 // === Equality ================================================
 
 func nativeEquals(args []Value, env *Env, loc *SrcLoc) (Value, error) {
@@ -189,105 +270,200 @@ func nativeNotEquals(args []Value, env *Env, loc *SrcLoc) (Value, error) {
 
 // === Binaty numeric ops ======================================
 
-func getOpNumbers(args []Value, loc *SrcLoc) (float64, float64, error) {
+// operator functions called directly compute the same as the operator
+// nodes
+func applyBinaryOp(op builtinOp, args []Value, loc *SrcLoc) (Value, error) {
+	if len(args) != 2 {
+		return nil, newExecError(loc, "2 arguments required")
+	}
+	return op.apply(args[0], args[1], loc)
+}
+
+func nativeAdd(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opAdd, args, loc)
+}
+
+func nativeSub(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	if len(args) == 1 {
+		return opNeg.apply(args[0], nil, loc)
+	}
+	return applyBinaryOp(opSub, args, loc)
+}
+
+func nativeMul(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opMul, args, loc)
+}
+
+func nativeDiv(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opDiv, args, loc)
+}
+
+func nativeMod(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opMod, args, loc)
+}
+
+func nativePow(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opPow, args, loc)
+}
+
+func nativeGreater(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opGreater, args, loc)
+}
+
+func nativeGreaterEqual(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opGreaterEqual, args, loc)
+}
+
+func nativeLess(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opLess, args, loc)
+}
+
+func nativeLessEqual(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	return applyBinaryOp(opLessEqual, args, loc)
+}
+
+// === Integers ================================================
+
+// the value printed by '%d': floats are only accepted if they hold a
+// whole number that fits in an int, instead of being truncated
+func printfInt(val Value, loc *SrcLoc) (int64, error) {
+	if v, ok := val.(*ValueInt); ok {
+		return v.num, nil
+	}
+	num, err := valueToNumber(val, loc)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := floatToInt64(num)
+	if !ok {
+		return 0, newExecError(loc, fmt.Sprintf("%%d needs a whole number, got %g", num))
+	}
+	return n, nil
+}
+
+func valueToInt64(val Value, loc *SrcLoc) (int64, error) {
+	if v, ok := val.(*ValueInt); ok {
+		return v.num, nil
+	}
+	return 0, newExecError(loc, fmt.Sprintf("'%s' is not an int", val.Type()))
+}
+
+func getOpInts(args []Value, loc *SrcLoc) (int64, int64, error) {
 	if len(args) != 2 {
 		return 0, 0, newExecError(loc, "2 arguments required")
 	}
-	x, err := valueToNumber(args[0], loc)
+	x, err := valueToInt64(args[0], loc)
 	if err != nil {
 		return 0, 0, err
 	}
-	y, err := valueToNumber(args[1], loc)
+	y, err := valueToInt64(args[1], loc)
 	if err != nil {
 		return 0, 0, err
 	}
 	return x, y, nil
 }
 
-func nativeAdd(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+// convert a number to int, rounding towards zero
+func nativeInt(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	if len(args) != 1 {
+		return nil, newExecError(loc, "1 argument required")
+	}
+	if v, ok := args[0].(*ValueInt); ok {
+		return v, nil
+	}
+	x, err := valueToNumber(args[0], loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueNumber(x + y), nil
+	n, ok := floatToInt64(math.Trunc(x))
+	if !ok {
+		return nil, newExecError(loc, fmt.Sprintf("can't convert %g to int", x))
+	}
+	return NewValueInt(n), nil
 }
 
-func nativeSub(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	if len(args) == 1 {
-		x, err := valueToNumber(args[0], loc)
-		if err != nil {
-			return nil, err
-		}
-		return NewValueNumber(-x), nil
+func nativeFloat(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	if len(args) != 1 {
+		return nil, newExecError(loc, "1 argument required")
 	}
-
-	x, y, err := getOpNumbers(args, loc)
+	x, err := valueToNumber(args[0], loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueNumber(x - y), nil
+	return NewValueNumber(x), nil
 }
 
-func nativeMul(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+// integer division, rounding towards zero like '%'
+func nativeDivInt(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	x, y, err := getOpInts(args, loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueNumber(x * y), nil
+	if y == 0 {
+		return nil, newExecError(loc, "integer division by zero")
+	}
+	return NewValueInt(x / y), nil
 }
 
-func nativeDiv(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+func nativeBitAnd(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	x, y, err := getOpInts(args, loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueNumber(x / y), nil
+	return NewValueInt(x & y), nil
 }
 
-func nativeMod(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+func nativeBitOr(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	x, y, err := getOpInts(args, loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueNumber(math.Mod(x, y)), nil
+	return NewValueInt(x | y), nil
 }
 
-func nativePow(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+func nativeBitXor(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	x, y, err := getOpInts(args, loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueNumber(math.Pow(x, y)), nil
+	return NewValueInt(x ^ y), nil
 }
 
-func nativeGreater(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+func nativeBitNot(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	if len(args) != 1 {
+		return nil, newExecError(loc, "1 argument required")
+	}
+	x, err := valueToInt64(args[0], loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueBool(x > y), nil
+	return NewValueInt(^x), nil
 }
 
-func nativeGreaterEqual(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+func getShift(args []Value, loc *SrcLoc) (int64, uint64, error) {
+	x, n, err := getOpInts(args, loc)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-	return NewValueBool(x >= y), nil
+	if n < 0 {
+		return 0, 0, newExecError(loc, fmt.Sprintf("negative shift count: %d", n))
+	}
+	return x, uint64(n), nil
 }
 
-func nativeLess(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+func nativeShiftLeft(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	x, n, err := getShift(args, loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueBool(x < y), nil
+	return NewValueInt(x << n), nil
 }
 
-func nativeLessEqual(args []Value, env *Env, loc *SrcLoc) (Value, error) {
-	x, y, err := getOpNumbers(args, loc)
+// arithmetic shift, keeping the sign
+func nativeShiftRight(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+	x, n, err := getShift(args, loc)
 	if err != nil {
 		return nil, err
 	}
-	return NewValueBool(x <= y), nil
+	return NewValueInt(x >> n), nil
 }
@@ -1,5 +1,11 @@
 package narfscript
 
+import (
+	"cmp"
+	"fmt"
+	"math"
+)
+
 type operatorAssoc int32
 
 const minOperatorPrec int32 = -(int32(^uint32(0) >> 1)) - 1
@@ -15,3 +21,336 @@ type bleepOperator struct {
 	prec  int32
 	assoc operatorAssoc
 }
+
+// operators computed directly by the interpreter while their variables
+// still hold the built-in functions
+type builtinOp int32
+
+const (
+	opEquals builtinOp = iota
+	opNotEquals
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opMod
+	opPow
+	opLess
+	opGreater
+	opLessEqual
+	opGreaterEqual
+	opNeg // unary '-', calls the function of opSub
+)
+
+var builtinOpFuncs = []*ValueNativeFunction{
+	opEquals:       NewValueNativeFunction(nativeEquals),
+	opNotEquals:    NewValueNativeFunction(nativeNotEquals),
+	opAdd:          NewValueNativeFunction(nativeAdd),
+	opSub:          NewValueNativeFunction(nativeSub),
+	opMul:          NewValueNativeFunction(nativeMul),
+	opDiv:          NewValueNativeFunction(nativeDiv),
+	opMod:          NewValueNativeFunction(nativeMod),
+	opPow:          NewValueNativeFunction(nativePow),
+	opLess:         NewValueNativeFunction(nativeLess),
+	opGreater:      NewValueNativeFunction(nativeGreater),
+	opLessEqual:    NewValueNativeFunction(nativeLessEqual),
+	opGreaterEqual: NewValueNativeFunction(nativeGreaterEqual),
+}
+
+var builtinBinaryOps = map[string]builtinOp{
+	"==": opEquals,
+	"!=": opNotEquals,
+	"+":  opAdd,
+	"-":  opSub,
+	"*":  opMul,
+	"/":  opDiv,
+	"%":  opMod,
+	"^":  opPow,
+	"<":  opLess,
+	">":  opGreater,
+	"<=": opLessEqual,
+	">=": opGreaterEqual,
+}
+
+// the built-in operator for a call of the named function with n arguments
+func findBuiltinOp(name string, n int) (builtinOp, bool) {
+	switch n {
+	case 1:
+		return opNeg, name == "-"
+	case 2:
+		op, ok := builtinBinaryOps[name]
+		return op, ok
+	}
+	return 0, false
+}
+
+// the function the operator variable holds by default
+func (op builtinOp) fun() *ValueNativeFunction {
+	if op == opNeg {
+		op = opSub
+	}
+	return builtinOpFuncs[op]
+}
+
+// number operated on without allocating a value for each result
+type opNum struct {
+	kind opNumKind
+	i    int64 // int value, or 1 for true and 0 for false
+	f    float64
+}
+
+type opNumKind uint8
+
+const (
+	opNumInt opNumKind = iota
+	opNumFloat
+	opNumBool
+)
+
+// the number held by an int or a float value
+func valueToOpNum(val Value) (opNum, bool) {
+	switch v := val.(type) {
+	case *ValueInt:
+		return opNum{kind: opNumInt, i: v.num}, true
+	case *ValueNumber:
+		return opNum{kind: opNumFloat, f: v.num}, true
+	}
+	return opNum{}, false
+}
+
+// the number of any numeric value, numbers other than ints are floats
+func numericToOpNum(n ValueNumeric) opNum {
+	if i, ok := n.(*ValueInt); ok {
+		return opNum{kind: opNumInt, i: i.num}
+	}
+	return opNum{kind: opNumFloat, f: n.Number()}
+}
+
+func (n opNum) float() float64 {
+	if n.kind == opNumFloat {
+		return n.f
+	}
+	return float64(n.i)
+}
+
+func (n opNum) value() Value {
+	switch n.kind {
+	case opNumInt:
+		return NewValueInt(n.i)
+	case opNumBool:
+		return NewValueBool(n.i != 0)
+	}
+	return NewValueNumber(n.f)
+}
+
+func boolOpNum(b bool) opNum {
+	if b {
+		return opNum{kind: opNumBool, i: 1}
+	}
+	return opNum{kind: opNumBool}
+}
+
+// ints are compared exactly, not rounded to floats
+func (n opNum) equals(m opNum) bool {
+	c, ok := n.compare(m)
+	return ok && c == 0
+}
+
+// compare two numbers like cmp.Compare, ints exactly; false if one of them
+// is NaN, which is neither less, equal nor greater than any number
+func (n opNum) compare(m opNum) (int, bool) {
+	switch {
+	case n.kind == opNumInt && m.kind == opNumInt:
+		return cmp.Compare(n.i, m.i), true
+	case n.kind == opNumInt:
+		return compareIntFloat(n.i, m.f)
+	case m.kind == opNumInt:
+		c, ok := compareIntFloat(m.i, n.f)
+		return -c, ok
+	}
+	if math.IsNaN(n.f) || math.IsNaN(m.f) {
+		return 0, false
+	}
+	return cmp.Compare(n.f, m.f), true
+}
+
+func compareIntFloat(i int64, f float64) (int, bool) {
+	switch {
+	case math.IsNaN(f):
+		return 0, false
+	case f >= 1<<63:
+		return -1, true
+	case f < -(1 << 63):
+		return 1, true
+	}
+	t := math.Trunc(f)
+	if c := cmp.Compare(i, int64(t)); c != 0 {
+		return c, true
+	}
+	return cmp.Compare(0, f-t), true
+}
+
+// compute the operator like its built-in function does; y is ignored by
+// unary operators. Operations on two ints give an int, except for '/',
+// negative powers and results too large for an int, anything else is
+// computed with floats.
+func (op builtinOp) apply(x, y Value, loc *SrcLoc) (Value, error) {
+	switch op {
+	case opEquals:
+		return NewValueBool(valuesAreEqual(x, y)), nil
+
+	case opNotEquals:
+		return NewValueBool(!valuesAreEqual(x, y)), nil
+	}
+
+	a, err := valueToOpNumArg(x, loc)
+	if err != nil {
+		return nil, err
+	}
+	var b opNum
+	if op != opNeg {
+		if b, err = valueToOpNumArg(y, loc); err != nil {
+			return nil, err
+		}
+	}
+	ret, ok := op.applyNum(a, b)
+	if !ok {
+		return nil, newExecError(loc, "integer division by zero")
+	}
+	return ret.value(), nil
+}
+
+func valueToOpNumArg(val Value, loc *SrcLoc) (opNum, error) {
+	if n, ok := valueToOpNum(val); ok {
+		return n, nil
+	}
+	if n, ok := val.(ValueNumeric); ok {
+		return numericToOpNum(n), nil
+	}
+	return opNum{}, newExecError(loc, fmt.Sprintf("'%s' is not a number", val.Type()))
+}
+
+// compute the operator on ints and floats, returning false if it can't be
+// computed: for bools, which are only compared by the generic operator,
+// and for an integer '%' by zero
+func (op builtinOp) applyNum(x, y opNum) (opNum, bool) {
+	if x.kind == opNumBool || (y.kind == opNumBool && op != opNeg) {
+		return opNum{}, false
+	}
+	switch op {
+	case opEquals:
+		return boolOpNum(x.equals(y)), true
+	case opNotEquals:
+		return boolOpNum(!x.equals(y)), true
+	case opNeg:
+		if x.kind == opNumInt && x.i != math.MinInt64 {
+			return opNum{kind: opNumInt, i: -x.i}, true
+		}
+		return opNum{kind: opNumFloat, f: -x.float()}, true
+	case opLess, opGreater, opLessEqual, opGreaterEqual:
+		c, ok := x.compare(y)
+		return boolOpNum(ok && op.orders(c)), true
+	}
+
+	if x.kind == opNumInt && y.kind == opNumInt {
+		return op.applyInt(x.i, y.i)
+	}
+
+	a, b := x.float(), y.float()
+	switch op {
+	case opAdd:
+		return opNum{kind: opNumFloat, f: a + b}, true
+	case opSub:
+		return opNum{kind: opNumFloat, f: a - b}, true
+	case opMul:
+		return opNum{kind: opNumFloat, f: a * b}, true
+	case opDiv:
+		return opNum{kind: opNumFloat, f: a / b}, true
+	case opMod:
+		return opNum{kind: opNumFloat, f: math.Mod(a, b)}, true
+	case opPow:
+		return opNum{kind: opNumFloat, f: math.Pow(a, b)}, true
+	}
+	return opNum{}, false
+}
+
+// whether the result of compare satisfies an ordering operator
+func (op builtinOp) orders(c int) bool {
+	switch op {
+	case opLess:
+		return c < 0
+	case opGreater:
+		return c > 0
+	case opLessEqual:
+		return c <= 0
+	case opGreaterEqual:
+		return c >= 0
+	}
+	return false
+}
+
+// integer arithmetic gives a float when the result doesn't fit in an
+// int, '%' has the sign of a
+func (op builtinOp) applyInt(a, b int64) (opNum, bool) {
+	switch op {
+	case opAdd:
+		if c := a + b; (c > a) == (b > 0) {
+			return opNum{kind: opNumInt, i: c}, true
+		}
+	case opSub:
+		if c := a - b; (c < a) == (b > 0) {
+			return opNum{kind: opNumInt, i: c}, true
+		}
+	case opMul:
+		if c, ok := mulInt(a, b); ok {
+			return opNum{kind: opNumInt, i: c}, true
+		}
+	case opDiv:
+		return opNum{kind: opNumFloat, f: float64(a) / float64(b)}, true
+	case opMod:
+		if b == 0 {
+			return opNum{}, false
+		}
+		return opNum{kind: opNumInt, i: a % b}, true
+	case opPow:
+		if c, ok := powInt(a, b); ok {
+			return opNum{kind: opNumInt, i: c}, true
+		}
+	default:
+		return opNum{}, false
+	}
+	return op.applyNum(opNum{kind: opNumFloat, f: float64(a)}, opNum{kind: opNumFloat, f: float64(b)})
+}
+
+// a * b, false if it overflows
+func mulInt(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if c/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return c, true
+}
+
+// a ^ b, false if b is negative or the result overflows
+func powInt(a, b int64) (int64, bool) {
+	if b < 0 {
+		return 0, false
+	}
+	ret := int64(1)
+	for ok := true; ; b >>= 1 {
+		if b&1 != 0 {
+			if ret, ok = mulInt(ret, a); !ok {
+				return 0, false
+			}
+		}
+		if b <= 1 {
+			return ret, true
+		}
+		if a, ok = mulInt(a, a); !ok {
+			return 0, false
+		}
+	}
+}
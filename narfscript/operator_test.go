@@ -0,0 +1,93 @@
+package narfscript
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestIntOperators(t *testing.T) {
+	tests := []struct {
+		expr string
+		a, b Value
+		want string
+	}{
+		// mixed ints and floats are compared exactly
+		{"a < b", NewValueInt(9007199254740993), NewValueNumber(9007199254740992), "false"},
+		{"a > b", NewValueInt(9007199254740993), NewValueNumber(9007199254740992), "true"},
+		{"a >= b", NewValueInt(9007199254740993), NewValueNumber(9007199254740992), "true"},
+		{"a == b", NewValueInt(9007199254740993), NewValueNumber(9007199254740992), "false"},
+		{"b < a", NewValueInt(9007199254740993), NewValueNumber(9007199254740992), "true"},
+		{"a <= b", NewValueInt(-3), NewValueNumber(-2.5), "true"},
+		{"a < b", NewValueInt(9223372036854775807), NewValueNumber(9223372036854775808), "true"},
+		{"a < b", NewValueInt(1), NewValueNumber(math.NaN()), "false"},
+		{"a >= b", NewValueInt(1), NewValueNumber(math.NaN()), "false"},
+
+		// results too large for an int are floats
+		{"a ^ b", NewValueInt(2), NewValueInt(62), "4611686018427387904"},
+		{"a ^ b", NewValueInt(2), NewValueInt(63), "9.223372036854776e+18"},
+		{"a ^ b", NewValueInt(2), NewValueInt(64), "1.8446744073709552e+19"},
+		{"a ^ b", NewValueInt(2), NewValueInt(100), "1.2676506002282294e+30"},
+		{"a ^ b", NewValueInt(10), NewValueInt(20), "1e+20"},
+		{"a ^ b", NewValueInt(-2), NewValueInt(63), "-9223372036854775808"},
+		{"a * b", NewValueInt(9223372036854775807), NewValueInt(2), "1.8446744073709552e+19"},
+		{"a * b", NewValueInt(-1), NewValueInt(-9223372036854775807 - 1), "9.223372036854776e+18"},
+		{"a + b", NewValueInt(9223372036854775807), NewValueInt(1), "9.223372036854776e+18"},
+		{"a - b", NewValueInt(-9223372036854775807), NewValueInt(2), "-9.223372036854776e+18"},
+		{"-a", NewValueInt(-9223372036854775807 - 1), nil, "9.223372036854776e+18"},
+		{"a + b", NewValueInt(9223372036854775806), NewValueInt(1), "9223372036854775807"},
+
+		// the smallest int can be written as a literal
+		{"-9223372036854775808", nil, nil, "-9223372036854775808"},
+		{"-9223372036854775808 == a", NewValueInt(-9223372036854775807 - 1), nil, "true"},
+		{"9223372036854775808", nil, nil, "9.223372036854776e+18"},
+		{"-9223372036854775808 ^ 1", nil, nil, "-9.223372036854776e+18"},
+	}
+
+	for _, b := range backends {
+		for _, test := range tests {
+			narf := parseTestScript(t, b.backend, "function main(a, b) { return "+test.expr+"; }")
+			ret, err := narf.CallFunction("main", []Value{test.a, test.b})
+			if err != nil {
+				t.Errorf("%s [%s]: %v", test.expr, b.name, err)
+				continue
+			}
+			if ret.String() != test.want {
+				t.Errorf("%s with %v, %v [%s]: got %s, want %s", test.expr, test.a, test.b, b.name, ret, test.want)
+			}
+		}
+	}
+}
+
+func TestPrintfInt(t *testing.T) {
+	for _, test := range []struct {
+		arg  string
+		want string
+		err  string
+	}{
+		{"42", "42", ""},
+		{"3.0", "3", ""},
+		{"-9223372036854775808", "-9223372036854775808", ""},
+		{"3.7", "", "%d needs a whole number, got 3.7"},
+		{"1e30", "", "%d needs a whole number, got 1e+30"},
+	} {
+		narf := NewNarf()
+		var out strings.Builder
+		narf.SetOutput(&out)
+		if err := narf.ParseString("test.tst", "function main() { printf(\"%d\", "+test.arg+"); }"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := narf.CallFunction("main", nil)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.arg, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.arg, err)
+		} else if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.arg, out.String(), test.want)
+		}
+	}
+}
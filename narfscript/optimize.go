@@ -0,0 +1,250 @@
+package narfscript
+
+// optimization pass over analyzed functions, run before they execute:
+// operator calls on literals are computed once, 'if' and 'while' with
+// constant conditions are reduced to the branch they select and literals
+// are allocated once instead of on each evaluation. String literals keep their own node, so their size is
+// still checked against the limits when they're used.
+//
+// operators, 'true', 'false' and 'null' are global variables the host or
+// the script can rebind, so a value computed from them is only used while
+// they hold the values it was computed with.
+
+// predefined globals used as constants
+var constGlobals = map[string]Value{
+	"null":  NewValueNull(),
+	"true":  NewValueBool(true),
+	"false": NewValueBool(false),
+}
+
+func optimizeFunc(def *execExprFuncDef) {
+	optimizeBlock(def.body)
+}
+
+func optimizeBlock(block *execStmtBlock) {
+	stmts := block.stmts[:0]
+	for _, stmt := range block.stmts {
+		if stmt = optimizeStmt(stmt); stmt != nil {
+			stmts = append(stmts, stmt)
+		}
+	}
+	block.stmts = stmts
+}
+
+// optimize a statement that can't be left out
+func optimizeBranch(stmt execStatement) execStatement {
+	if stmt = optimizeStmt(stmt); stmt != nil {
+		return stmt
+	}
+	return &execStmtBlock{}
+}
+
+// returns the optimized statement, or nil if it does nothing
+func optimizeStmt(stmt execStatement) execStatement {
+	switch s := stmt.(type) {
+	case *execStmtBlock:
+		optimizeBlock(s)
+
+	case *execStmtVar:
+		s.val = optimizeExpr(s.val)
+
+	case *execStmtIf:
+		s.test_expr = optimizeExpr(s.test_expr)
+		s.true_stmt = optimizeBranch(s.true_stmt)
+		if s.false_stmt != nil {
+			s.false_stmt = optimizeStmt(s.false_stmt)
+		}
+		if val, guards, ok := foldedExpr(s.test_expr); ok {
+			branch := s.false_stmt
+			if valueIsTrue(val) {
+				branch = s.true_stmt
+			}
+			return foldedStmt(branch, guards, s)
+		}
+
+	case *execStmtWhile:
+		s.test_expr = optimizeExpr(s.test_expr)
+		s.stmt = optimizeBranch(s.stmt)
+		if val, guards, ok := foldedExpr(s.test_expr); ok && !valueIsTrue(val) {
+			return foldedStmt(nil, guards, s)
+		}
+
+	case *execStmtReturn:
+		if s.retval != nil {
+			s.retval = optimizeExpr(s.retval)
+		}
+
+	case *execStmtExpression:
+		s.e = optimizeExpr(s.e)
+	}
+	return stmt
+}
+
+func optimizeExprs(exprs []execExpression) {
+	for i, e := range exprs {
+		exprs[i] = optimizeExpr(e)
+	}
+}
+
+func optimizeExpr(expr execExpression) execExpression {
+	switch e := expr.(type) {
+	case *execExprNumber:
+		return &execExprConst{NewValueNumber(e.num)}
+
+	case *execExprInt:
+		return &execExprConst{NewValueInt(e.num)}
+
+	case *execExprIdent:
+		if val, ok := constGlobals[e.name]; ok && e.ref.kind == varGlobal {
+			return &execExprFolded{val, []execGuard{{e.ref, val}}, e}
+		}
+
+	case *execExprVarAssignment:
+		e.val = optimizeExpr(e.val)
+
+	case *execExprFuncDef:
+		optimizeFunc(e)
+
+	case *execExprVectorLiteral:
+		optimizeExprs(e.elements)
+
+	case *execExprMapLiteral:
+		for i := range e.elements {
+			e.elements[i][0] = optimizeExpr(e.elements[i][0])
+			e.elements[i][1] = optimizeExpr(e.elements[i][1])
+		}
+
+	case *execExprElementIndex:
+		e.container = optimizeExpr(e.container)
+		e.index = optimizeExpr(e.index)
+
+	case *execExprContainerSet:
+		e.container = optimizeExpr(e.container)
+		e.index = optimizeExpr(e.index)
+		e.val = optimizeExpr(e.val)
+
+	case *execExprDot:
+		e.obj = optimizeExpr(e.obj)
+
+	case *execExprDotSet:
+		e.obj = optimizeExpr(e.obj)
+		e.val = optimizeExpr(e.val)
+
+	case *execExprFuncCall:
+		e.fun = optimizeExpr(e.fun)
+		optimizeExprs(e.args)
+
+	case *execExprMethodCall:
+		e.obj = optimizeExpr(e.obj)
+		optimizeExprs(e.args)
+
+	case *execExprOperator:
+		return optimizeOperator(e)
+
+	case *execExprNot:
+		e.val = optimizeExpr(e.val)
+		if val, guards, ok := foldedExpr(e.val); ok {
+			return newFolded(NewValueBool(!valueIsTrue(val)), guards, e)
+		}
+
+	case *execExprAnd:
+		e.left = optimizeExpr(e.left)
+		e.right = optimizeExpr(e.right)
+		return optimizeLogical(e, e.left, e.right, false)
+
+	case *execExprOr:
+		e.left = optimizeExpr(e.left)
+		e.right = optimizeExpr(e.right)
+		return optimizeLogical(e, e.left, e.right, true)
+	}
+	return expr
+}
+
+// fold an operator whose arguments are all constant
+func optimizeOperator(e *execExprOperator) execExpression {
+	optimizeExprs(e.call.args)
+
+	guards := []execGuard{{e.ident.ref, e.fun}}
+	var vals [2]Value
+	for i, arg := range e.call.args {
+		val, arg_guards, ok := foldedExpr(arg)
+		if !ok {
+			return e
+		}
+		vals[i] = val
+		guards = addGuards(guards, arg_guards)
+	}
+
+	// errors are left to be reported when the expression runs
+	val, err := e.op.apply(vals[0], vals[1], &e.call.loc)
+	if err != nil {
+		return e
+	}
+	return newFolded(val, guards, e)
+}
+
+// fold '&&' (stop_at is false) or '||' (stop_at is true) when the result
+// doesn't depend on anything computed at run time
+func optimizeLogical(e, left, right execExpression, stop_at bool) execExpression {
+	left_val, left_guards, ok := foldedExpr(left)
+	if !ok {
+		return e
+	}
+	if valueIsTrue(left_val) == stop_at {
+		return newFolded(NewValueBool(stop_at), left_guards, e)
+	}
+	right_val, right_guards, ok := foldedExpr(right)
+	if !ok {
+		return e
+	}
+	guards := addGuards(addGuards(nil, left_guards), right_guards)
+	return newFolded(NewValueBool(valueIsTrue(right_val)), guards, e)
+}
+
+// the value of an expression the optimizer has reduced to a constant,
+// with the globals it depends on
+func foldedExpr(expr execExpression) (Value, []execGuard, bool) {
+	switch e := expr.(type) {
+	case *execExprConst:
+		return e.val, nil, true
+	case *execExprString:
+		return e.val, nil, true
+	case *execExprFolded:
+		return e.val, e.guards, true
+	}
+	return nil, nil, false
+}
+
+// the statement selected by a computed condition, which is nil if it
+// doesn't run anything; conditions depending on globals keep the original
+// statement for when they change
+func foldedStmt(stmt execStatement, guards []execGuard, orig execStatement) execStatement {
+	if len(guards) == 0 {
+		return stmt
+	}
+	return &execStmtFolded{guards, stmt, orig}
+}
+
+func newFolded(val Value, guards []execGuard, expr execExpression) execExpression {
+	if len(guards) == 0 {
+		return &execExprConst{val}
+	}
+	return &execExprFolded{val, guards, expr}
+}
+
+// add guards for globals not guarded yet
+func addGuards(guards []execGuard, add []execGuard) []execGuard {
+	for _, g := range add {
+		found := false
+		for _, h := range guards {
+			if h.ref == g.ref {
+				found = true
+				break
+			}
+		}
+		if !found {
+			guards = append(guards, g)
+		}
+	}
+	return guards
+}
@@ -0,0 +1,77 @@
+package narfscript
+
+import (
+	"testing"
+)
+
+func findDef(t *testing.T, narf *Narf, name string) *execExprFuncDef {
+	t.Helper()
+	for _, f := range narf.defs {
+		if f.def.name == name {
+			return f.def
+		}
+	}
+	t.Fatalf("function '%s' not found", name)
+	return nil
+}
+
+func TestOptimizeBranches(t *testing.T) {
+	src := `function f() {
+		var n = 0;
+		if (0) { n = 1; }
+		if (false) { n = 2; }
+		if (1 < 2) { n = 3; } else { n = 4; }
+		while (false) { n = 5; }
+		return n;
+	}`
+	narf := parseTestScript(t, BackendTree, src)
+	stmts := findDef(t, narf, "f").body.stmts
+	if len(stmts) != 5 {
+		t.Fatalf("got %d statements, want 5", len(stmts))
+	}
+	if _, ok := stmts[0].(*execStmtVar); !ok {
+		t.Errorf("statement 0 is %T, want the var", stmts[0])
+	}
+	if s, ok := stmts[1].(*execStmtFolded); !ok || s.stmt != nil {
+		t.Errorf("'if (false)': got %T, want a folded statement running nothing", stmts[1])
+	}
+	if s, ok := stmts[2].(*execStmtFolded); !ok || s.stmt != s.orig.(*execStmtIf).true_stmt {
+		t.Errorf("'if (1 < 2)': got %T, want a folded statement running the true branch", stmts[2])
+	}
+	if s, ok := stmts[3].(*execStmtFolded); !ok || s.stmt != nil {
+		t.Errorf("'while (false)': got %T, want a folded statement running nothing", stmts[3])
+	}
+	if _, ok := stmts[4].(*execStmtReturn); !ok {
+		t.Errorf("statement 4 is %T, want the return", stmts[4])
+	}
+}
+
+// the original statement runs once a global its condition depends on changes
+func TestOptimizeBranchesRebound(t *testing.T) {
+	src := "function main() { if (false) return 1; if (1 > 2) return 2; return 3; }"
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, src)
+		for _, test := range []struct {
+			name string
+			val  Value
+			want string
+		}{
+			{"", nil, "3"},
+			{">", NewValueNativeFunction(func(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+				return NewValueBool(true), nil
+			}), "2"},
+			{"false", NewValueBool(true), "1"},
+		} {
+			if test.val != nil {
+				narf.AddVar(test.name, test.val)
+			}
+			ret, err := narf.CallFunction("main", nil)
+			if err != nil {
+				t.Fatalf("[%s]: %v", b.name, err)
+			}
+			if ret.String() != test.want {
+				t.Errorf("[%s] %s: got %s, want %s", b.name, test.name, ret, test.want)
+			}
+		}
+	}
+}
@@ -2,17 +2,33 @@ package narfscript
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"os"
 )
 
+// osFS opens files from the OS filesystem, accepting any path os.Open accepts
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
 type bleepParser struct {
 	in          []*bleepTokenizer
+	fsys        fs.FS
 	keywords    map[string]bool
 	operators   []bleepOperator
 	elIndexPrec int32
 	funCallPrec int32
 	last_tok    *token
-	tok_saved   bool
+	saved       []*token // tokens to be read again, last one first
+	eof_loc     SrcLoc
+	depth       int
+	errors      ParseErrorList
+	diag        *Diagnostics
+	script_mode bool
 }
 
 func newParser(keywords map[string]bool, operators []bleepOperator, elIndexPrec, funCallPrec int32) *bleepParser {
@@ -26,63 +42,138 @@ func newParser(keywords map[string]bool, operators []bleepOperator, elIndexPrec,
 }
 
 func (parser *bleepParser) openFile(filename string) error {
-	file, err := os.Open(filename)
+	if parser.fsys == nil {
+		return fmt.Errorf("can't include '%s': no filesystem to read it from", filename)
+	}
+	file, err := parser.fsys.Open(filename)
 	if err != nil {
 		return err
 	}
-	parser.in = append(parser.in, newTokenizer(file, parser.keywords, parser.operators))
+	tokenizer := newTokenizer(parser.keepSource(filename, file), filename, parser.keywords, parser.operators)
+	tokenizer.closer = file
+	parser.in = append(parser.in, tokenizer)
 	return nil
 }
 
+func (parser *bleepParser) openReader(name string, in io.Reader) {
+	parser.in = append(parser.in, newTokenizer(parser.keepSource(name, in), name, parser.keywords, parser.operators))
+}
+
+// copy the source to the diagnostics as it's read
+func (parser *bleepParser) keepSource(name string, in io.Reader) io.Reader {
+	if parser.diag == nil {
+		return in
+	}
+	return io.TeeReader(in, parser.diag.newSource(name))
+}
+
+func (parser *bleepParser) reset(fsys fs.FS) {
+	for _, in := range parser.in {
+		in.close()
+	}
+	parser.in = parser.in[:0]
+	parser.fsys = fsys
+	parser.last_tok = nil
+	parser.saved = parser.saved[:0]
+	parser.eof_loc = SrcLoc{}
+	parser.depth = 0
+	parser.errors = nil
+}
+
 func (parser *bleepParser) getToken() *token {
 	// return saved token if any
-	if parser.tok_saved {
-		parser.tok_saved = false
+	if n := len(parser.saved); n > 0 {
+		parser.last_tok = parser.saved[n-1]
+		parser.saved = parser.saved[:n-1]
 		return parser.last_tok
 	}
 
 	// read next token from current input, go to next input on EOF
-	var eof_loc SrcLoc
 	for len(parser.in) > 0 {
 		cur_in := len(parser.in) - 1
-		parser.last_tok = parser.in[cur_in].Next()
-		if !parser.last_tok.isEOF() {
-			return parser.last_tok
+		tok := parser.in[cur_in].Next()
+		if !tok.isEOF() {
+			parser.setDepth(tok)
+			parser.last_tok = tok
+			return tok
 		}
-		if eof_loc.Line == 0 {
-			eof_loc = parser.in[cur_in].getSrcLoc()
+		if cur_in == 0 {
+			parser.eof_loc = parser.in[cur_in].getSrcLoc()
 		}
+		parser.in[cur_in].close()
 		parser.in = parser.in[:cur_in]
 	}
 
-	return newTokenEOF(eof_loc)
+	parser.last_tok = newTokenEOF(parser.eof_loc)
+	parser.last_tok.end = parser.eof_loc
+	return parser.last_tok
 }
 
-func (parser *bleepParser) ungetToken() bool {
-	if parser.tok_saved {
-		return false
+// matching braces get the same depth, tokens between them one more
+func (parser *bleepParser) setDepth(tok *token) {
+	switch {
+	case tok.isPunct('{'):
+		tok.depth = parser.depth
+		parser.depth++
+	case tok.isPunct('}'):
+		if parser.depth > 0 {
+			parser.depth--
+			tok.depth = parser.depth
+		} else {
+			tok.depth = -1
+		}
+	default:
+		tok.depth = parser.depth
 	}
-	parser.tok_saved = true
-	return true
+}
+
+func (parser *bleepParser) ungetToken() {
+	parser.saved = append(parser.saved, parser.last_tok)
 }
 
 func (parser *bleepParser) peekToken() *token {
-	if parser.tok_saved {
-		return parser.last_tok
+	tok := parser.getToken()
+	parser.ungetToken()
+	return tok
+}
+
+// check if the next tokens start a named function, which is only valid at the top level
+func (parser *bleepParser) atFuncDecl() bool {
+	tok := parser.getToken()
+	next := parser.getToken()
+	parser.ungetToken()
+	parser.last_tok = tok
+	parser.ungetToken()
+	return tok.isKeyword("function") && next.isIdent()
+}
+
+// the digits of the smallest int don't fit in an int, so the literal is
+// only an int when it directly follows a prefix '-' that negates just it
+func (parser *bleepParser) isMinInt(tok *token, stacks *exprStacks) bool {
+	if tok.str != "9223372036854775808" || stacks.numOperators() == 0 {
+		return false
+	}
+	op := stacks.peekOperator().op
+	if op.ident != "-" || op.assoc != operatorAssocPrefix {
+		return false
 	}
-	return parser.getToken()
+	next := parser.peekToken()
+	return !(next.isOp() && next.str == "^")
 }
 
 func (parser *bleepParser) errMessage(loc *SrcLoc, msg string) error {
-	return newParserError(loc, msg)
+	return newParseError(ParseErrorSyntax, loc, msg)
 }
 
 func (parser *bleepParser) errUnexpected(tok *token, expected string) error {
-	return parser.errMessage(&tok.loc, fmt.Sprintf("expected %s, found %v", expected, tok))
+	if tok.isError() {
+		return newParseErrorFromTok(ParseErrorToken, tok, tok.str)
+	}
+	return newParseErrorFromTok(ParseErrorSyntax, tok, fmt.Sprintf("expected %s, found %v", expected, tok))
 }
 
 func (parser *bleepParser) errPanic(tok *token, msg string) error {
-	return newParserErrorFromTok(tok, msg)
+	return newParseErrorFromTok(ParseErrorInternal, tok, msg)
 }
 
 func (parser *bleepParser) expectPunct(ch rune) error {
@@ -90,7 +181,45 @@ func (parser *bleepParser) expectPunct(ch rune) error {
 	if tok.isPunct(ch) {
 		return nil
 	}
-	return newParserErrorFromTok(tok, fmt.Sprintf("expected '%c', found %v", ch, tok))
+	return parser.errUnexpected(tok, fmt.Sprintf("'%c'", ch))
+}
+
+// skip tokens after a syntax error in a statement at the given brace
+// depth, stopping after a ';' or a '}' that closes a nested block, or
+// before a '}' that closes the enclosing block or a named function
+func (parser *bleepParser) synchronize(depth int) {
+	// the token where the error was found may end the statement
+	if n := len(parser.saved); n == 0 || parser.saved[n-1] != parser.last_tok {
+		parser.ungetToken()
+	}
+
+	for !parser.atFuncDecl() {
+		tok := parser.getToken()
+		switch {
+		case tok.isEOF():
+			parser.ungetToken()
+			return
+
+		case tok.isPunct(';') && tok.depth == depth:
+			return
+
+		case tok.isPunct('}') && tok.depth == depth:
+			return
+
+		case tok.isPunct('}') && tok.depth < depth:
+			parser.ungetToken()
+			return
+		}
+	}
+}
+
+// record an error and skip to the next top level declaration
+func (parser *bleepParser) recover(err error) {
+	parser.errors.add(err)
+	parser.synchronize(0)
+	if tok := parser.peekToken(); tok.isPunct('}') {
+		parser.getToken()
+	}
 }
 
 // -------------------------------------------------------------------
@@ -130,6 +259,9 @@ func (parser *bleepParser) parseExpression(stop []rune, consume_stop bool) (astE
 			}
 
 			if found_stop {
+				if expect_opn {
+					return nil, parser.errUnexpected(tok, "expression")
+				}
 				if !consume_stop {
 					parser.ungetToken()
 				}
@@ -265,7 +397,7 @@ func (parser *bleepParser) parseExpression(stop []rune, consume_stop bool) (astE
 			if !expect_opn {
 				return nil, parser.errUnexpected(tok, "operator or '('")
 			}
-			stacks.pushOperand(&astExprString{tok.str})
+			stacks.pushOperand(&astExprString{tok.str, tok.loc})
 			expect_opn = false
 			continue
 		}
@@ -274,7 +406,21 @@ func (parser *bleepParser) parseExpression(stop []rune, consume_stop bool) (astE
 			if !expect_opn {
 				return nil, parser.errUnexpected(tok, "operator or '('")
 			}
-			stacks.pushOperand(&astExprNumber{tok.num})
+			if parser.isMinInt(tok, stacks) {
+				stacks.popOperator()
+				stacks.pushOperand(&astExprInt{math.MinInt64})
+			} else {
+				stacks.pushOperand(&astExprNumber{tok.num})
+			}
+			expect_opn = false
+			continue
+		}
+
+		if tok.isInt() {
+			if !expect_opn {
+				return nil, parser.errUnexpected(tok, "operator or '('")
+			}
+			stacks.pushOperand(&astExprInt{tok.int_num})
 			expect_opn = false
 			continue
 		}
@@ -315,6 +461,7 @@ func (parser *bleepParser) parseExpression(stop []rune, consume_stop bool) (astE
 
 // map: { expr : expr, ...}
 func (parser *bleepParser) parseMapLiteral() (*astExprMapLiteral, error) {
+	loc := parser.peekToken().loc
 	if err := parser.expectPunct('{'); err != nil {
 		return nil, err
 	}
@@ -328,7 +475,7 @@ func (parser *bleepParser) parseMapLiteral() (*astExprMapLiteral, error) {
 		if !next.isIdent() && !next.isString() {
 			return nil, parser.errUnexpected(next, "identifier or string")
 		}
-		key := &astExprString{next.str}
+		key := &astExprString{next.str, next.loc}
 
 		if err := parser.expectPunct(':'); err != nil {
 			return nil, err
@@ -352,12 +499,14 @@ func (parser *bleepParser) parseMapLiteral() (*astExprMapLiteral, error) {
 
 	ret := &astExprMapLiteral{
 		elements: elements,
+		loc:      loc,
 	}
 	return ret, nil
 }
 
 // vector: [expr, ...]
 func (parser *bleepParser) parseVectorLiteral() (*astExprVectorLiteral, error) {
+	loc := parser.peekToken().loc
 	if err := parser.expectPunct('['); err != nil {
 		return nil, err
 	}
@@ -368,6 +517,7 @@ func (parser *bleepParser) parseVectorLiteral() (*astExprVectorLiteral, error) {
 	if next.isPunct(']') {
 		ret := &astExprVectorLiteral{
 			elements: elements,
+			loc:      loc,
 		}
 		return ret, nil
 	}
@@ -391,6 +541,7 @@ func (parser *bleepParser) parseVectorLiteral() (*astExprVectorLiteral, error) {
 
 	ret := &astExprVectorLiteral{
 		elements: elements,
+		loc:      loc,
 	}
 	return ret, nil
 }
@@ -428,35 +579,37 @@ func (parser *bleepParser) parseArgumentList() ([]astExpression, error) {
 }
 
 // param list: (name, ...)
-func (parser *bleepParser) parseParamList() ([]string, error) {
+func (parser *bleepParser) parseParamList() ([]string, []SrcLoc, error) {
 	if err := parser.expectPunct('('); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	params := make([]string, 0)
+	locs := make([]SrcLoc, 0)
 
 	next := parser.getToken()
 	if next.isPunct(')') {
-		return params, nil
+		return params, locs, nil
 	}
 	parser.ungetToken()
 
 	for {
 		param := parser.getToken()
 		if !param.isIdent() {
-			return nil, parser.errUnexpected(param, "parameter name")
+			return nil, nil, parser.errUnexpected(param, "parameter name")
 		}
 		params = append(params, param.str)
+		locs = append(locs, param.loc)
 
 		sep := parser.getToken()
 		if !sep.isPunct(',') && !sep.isPunct(')') {
-			return nil, parser.errUnexpected(sep, "',' or ')'")
+			return nil, nil, parser.errUnexpected(sep, "',' or ')'")
 		}
 		if sep.isPunct(')') {
 			break
 		}
 	}
-	return params, nil
+	return params, locs, nil
 }
 
 // var
@@ -476,8 +629,8 @@ func (parser *bleepParser) parseVar() (*astStmtVar, error) {
 			return nil, err
 		}
 		val = v
-	} else {
-		parser.ungetToken()
+	} else if !next.isPunct(';') {
+		return nil, parser.errUnexpected(next, "'=' or ';'")
 	}
 
 	ret := &astStmtVar{
@@ -489,7 +642,7 @@ func (parser *bleepParser) parseVar() (*astStmtVar, error) {
 }
 
 // if
-func (parser *bleepParser) parseIf() (*astStmtIf, error) {
+func (parser *bleepParser) parseIf(loc SrcLoc) (*astStmtIf, error) {
 	if err := parser.expectPunct('('); err != nil {
 		return nil, err
 	}
@@ -517,12 +670,13 @@ func (parser *bleepParser) parseIf() (*astStmtIf, error) {
 		test_expr:  test_expr,
 		true_stmt:  true_stmt,
 		false_stmt: false_stmt,
+		loc:        loc,
 	}
 	return ret, nil
 }
 
 // while
-func (parser *bleepParser) parseWhile() (*astStmtWhile, error) {
+func (parser *bleepParser) parseWhile(loc SrcLoc) (*astStmtWhile, error) {
 	if err := parser.expectPunct('('); err != nil {
 		return nil, err
 	}
@@ -538,12 +692,13 @@ func (parser *bleepParser) parseWhile() (*astStmtWhile, error) {
 	ret := &astStmtWhile{
 		test_expr: test_expr,
 		stmt:      stmt,
+		loc:       loc,
 	}
 	return ret, nil
 }
 
 // return
-func (parser *bleepParser) parseReturn() (*astStmtReturn, error) {
+func (parser *bleepParser) parseReturn(loc SrcLoc) (*astStmtReturn, error) {
 	next := parser.getToken()
 	retval := astExpression(nil)
 	if !next.isPunct(';') {
@@ -554,7 +709,7 @@ func (parser *bleepParser) parseReturn() (*astStmtReturn, error) {
 		}
 		retval = expr
 	}
-	ret := &astStmtReturn{retval}
+	ret := &astStmtReturn{retval, loc}
 	return ret, nil
 }
 
@@ -570,6 +725,7 @@ func (parser *bleepParser) parseStatement() (astStatement, error) {
 	if tok.isPunct(';') {
 		block := &astStmtBlock{
 			make([]astStatement, 0),
+			tok.loc,
 		}
 		return block, nil
 	}
@@ -587,17 +743,17 @@ func (parser *bleepParser) parseStatement() (astStatement, error) {
 
 	// if
 	if tok.isKeyword("if") {
-		return parser.parseIf()
+		return parser.parseIf(tok.loc)
 	}
 
 	// while
 	if tok.isKeyword("while") {
-		return parser.parseWhile()
+		return parser.parseWhile(tok.loc)
 	}
 
 	// return
 	if tok.isKeyword("return") {
-		return parser.parseReturn()
+		return parser.parseReturn(tok.loc)
 	}
 
 	// break
@@ -614,7 +770,7 @@ func (parser *bleepParser) parseStatement() (astStatement, error) {
 	if err != nil {
 		return nil, err
 	}
-	ret := &astStmtExpression{expr}
+	ret := &astStmtExpression{expr, tok.loc}
 	return ret, nil
 }
 
@@ -623,6 +779,8 @@ func (parser *bleepParser) parseBlock() (*astStmtBlock, error) {
 	if err := parser.expectPunct('{'); err != nil {
 		return nil, err
 	}
+	loc := parser.last_tok.loc
+	depth := parser.last_tok.depth + 1
 
 	stmts := make([]astStatement, 0)
 	for {
@@ -631,23 +789,33 @@ func (parser *bleepParser) parseBlock() (*astStmtBlock, error) {
 			break
 		}
 		parser.ungetToken()
+		if tok.isEOF() || parser.atFuncDecl() {
+			return nil, parser.errUnexpected(tok, "'}'")
+		}
 
 		stmt, err := parser.parseStatement()
 		if err != nil {
-			return nil, err
+			// go on with the next statement unless the block is never closed
+			parser.synchronize(depth)
+			if parser.peekToken().isEOF() || parser.atFuncDecl() {
+				return nil, err
+			}
+			parser.errors.add(err)
+			continue
 		}
 		stmts = append(stmts, stmt)
 	}
 
 	block := &astStmtBlock{
 		stmts: stmts,
+		loc:   loc,
 	}
 	return block, nil
 }
 
 // function definition
 func (parser *bleepParser) parseFuncDef() (*astExprFuncDef, error) {
-	params, err := parser.parseParamList()
+	params, param_locs, err := parser.parseParamList()
 	if err != nil {
 		return nil, err
 	}
@@ -658,8 +826,9 @@ func (parser *bleepParser) parseFuncDef() (*astExprFuncDef, error) {
 	}
 
 	func_def := &astExprFuncDef{
-		params: params,
-		body:   body,
+		params:     params,
+		param_locs: param_locs,
+		body:       body,
 	}
 	return func_def, nil
 }
@@ -679,30 +848,49 @@ func (parser *bleepParser) parseNamedFuncDef() (*astNamedFuncDef, error) {
 	named_func_def := &astNamedFuncDef{
 		name: name.str,
 		def:  func_def,
+		loc:  name.loc,
 	}
 	return named_func_def, nil
 }
 
-func (parser *bleepParser) Parse(filename string) ([]*astNamedFuncDef, error) {
+func (parser *bleepParser) ParseFile(fsys fs.FS, filename string) (*astScript, error) {
+	parser.reset(fsys)
 	if err := parser.openFile(filename); err != nil {
 		return nil, err
 	}
+	return parser.parse()
+}
 
-	funcs := make([]*astNamedFuncDef, 0)
+func (parser *bleepParser) ParseReader(fsys fs.FS, name string, in io.Reader) (*astScript, error) {
+	parser.reset(fsys)
+	parser.openReader(name, in)
+	return parser.parse()
+}
+
+func (parser *bleepParser) parse() (*astScript, error) {
+	defer parser.reset(nil)
+
+	script := &astScript{
+		funcs: make([]*astNamedFuncDef, 0),
+		vars:  make([]*astStmtVar, 0),
+		stmts: make([]astStatement, 0),
+	}
 
 	for {
 		tok := parser.getToken()
 
 		if tok.isEOF() {
-			return funcs, nil
+			break
 		}
 
 		if tok.isKeyword("include") {
 			filename := parser.getToken()
-			if filename.isString() {
-				if err := parser.openFile(filename.str); err != nil {
-					return nil, newParserErrorFromTok(filename, err.Error())
-				}
+			if !filename.isString() {
+				parser.recover(parser.errUnexpected(filename, "file name"))
+				continue
+			}
+			if err := parser.openFile(filename.str); err != nil {
+				parser.errors.add(newParseErrorFromTok(ParseErrorInclude, filename, err.Error()))
 			}
 			continue
 		}
@@ -710,12 +898,40 @@ func (parser *bleepParser) Parse(filename string) ([]*astNamedFuncDef, error) {
 		if tok.isKeyword("function") {
 			func_def, err := parser.parseNamedFuncDef()
 			if err != nil {
-				return nil, err
+				parser.recover(err)
+				continue
 			}
-			funcs = append(funcs, func_def)
+			script.funcs = append(script.funcs, func_def)
 			continue
 		}
 
-		return nil, parser.errUnexpected(tok, "'function' or 'include'")
+		// in script mode everything else is a statement of the entry function
+		if parser.script_mode {
+			parser.ungetToken()
+			stmt, err := parser.parseStatement()
+			if err != nil {
+				parser.recover(err)
+				continue
+			}
+			script.stmts = append(script.stmts, stmt)
+			continue
+		}
+
+		if tok.isKeyword("var") {
+			v, err := parser.parseVar()
+			if err != nil {
+				parser.recover(err)
+				continue
+			}
+			script.vars = append(script.vars, v)
+			continue
+		}
+
+		parser.recover(parser.errUnexpected(tok, "'function', 'var' or 'include'"))
+	}
+
+	if len(parser.errors) > 0 {
+		return nil, parser.errors
 	}
+	return script, nil
 }
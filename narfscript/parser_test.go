@@ -0,0 +1,104 @@
+package narfscript
+
+import (
+	"fmt"
+	"testing"
+)
+
+// each error is reported once, at the position where it was found, and
+// parsing goes on with the next statement or function
+func TestParseErrorRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "syntax errors in each function",
+			src: `function a() {
+	var x = ;
+	return 1;
+}
+function b() {
+	return 2 + 3 4;
+}
+function c() {
+	var v = [1, 2;
+	return v;
+}
+`,
+			want: []string{"2:10 syntax", "6:15 syntax", "9:15 syntax"},
+		},
+		{
+			name: "analysis errors in each function",
+			src: `function a(x) {
+	return y;
+}
+function b() {
+	break;
+}
+function c() {
+	1 = 2;
+}
+`,
+			want: []string{"2:9 undeclared", "5:2 break", "8:4 assignment"},
+		},
+		{
+			name: "unclosed brace",
+			src: `function a() {
+	if (1 {
+		return 1;
+		var q = 1;
+		q = q + 1;
+	}
+	return 2;
+}
+function b() {
+	return 2 +;
+}
+`,
+			want: []string{"2:8 syntax", "10:12 syntax"},
+		},
+		{
+			name: "missing closing brace",
+			src: `function a() {
+	while (1) {
+		var n = 1;
+	return n;
+}
+function b() {
+	return 2 +;
+}
+`,
+			want: []string{"6:1 syntax", "7:12 syntax"},
+		},
+		{
+			name: "extra closing brace",
+			src: `function a() {
+	return 1;
+}
+}
+function b() {
+	return 2 +;
+}
+`,
+			want: []string{"4:1 syntax", "6:12 syntax"},
+		},
+	}
+	for _, test := range tests {
+		narf := NewNarf()
+		err := narf.ParseString("test.tst", test.src)
+		list, ok := err.(ParseErrorList)
+		if !ok {
+			t.Errorf("%s: got error %v, want a ParseErrorList", test.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range list {
+			got = append(got, fmt.Sprintf("%d:%d %s", e.Pos.Line, e.Pos.Col, e.Code))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got errors %v, want %v\n%s", test.name, got, test.want, err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package narfscript
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// analyzed functions and initial global values, never changed after Compile,
+// so a Program can be shared between goroutines. Vectors and maps are
+// copied by Compile and by each NewInstance.
+type Program struct {
+	symtab  *symTab
+	globals []Value
+	funcs   []*programFunc
+	inits   []*globalInit
+	entries []*execExprFuncDef
+	limits  Limits
+	backend Backend
+}
+
+type programFunc struct {
+	index int
+	def   *execExprFuncDef
+}
+
+// top level 'var' initializer
+type globalInit struct {
+	index int
+	val   execExpression
+}
+
+func (bleep *Narf) Compile() (*Program, error) {
+	if bleep.parse_err != nil {
+		return nil, errors.New("can't compile script with errors")
+	}
+	prog := &Program{
+		symtab:  bleep.symtab.clone(),
+		globals: make([]Value, bleep.env.size()),
+		funcs:   make([]*programFunc, 0, len(bleep.defs)),
+		inits:   make([]*globalInit, len(bleep.inst.inits)),
+		entries: make([]*execExprFuncDef, len(bleep.inst.entries)),
+		limits:  bleep.inst.limits,
+		backend: bleep.inst.backend,
+	}
+	copyGlobals(prog.globals, bleep.env.vals)
+	for _, f := range bleep.defs {
+		prog.globals[f.index] = nil
+		prog.funcs = append(prog.funcs, f)
+	}
+	copy(prog.inits, bleep.inst.inits)
+	copy(prog.entries, bleep.inst.entries)
+	for _, init := range prog.inits {
+		prog.globals[init.index] = nil
+	}
+	return prog, nil
+}
+
+// creates an instance with its own global variables
+func (prog *Program) NewInstance() *Instance {
+	env := newEnv(nil, len(prog.globals))
+	copyGlobals(env.vals, prog.globals)
+	for _, f := range prog.funcs {
+		env.vals[f.index] = &ValueClosure{
+			fun: f.def,
+			env: env,
+		}
+	}
+	inst := newInstance(prog.symtab, env, prog.limits)
+	inst.inits = prog.inits
+	inst.entries = prog.entries
+	inst.backend = prog.backend
+	return inst
+}
+
+// copy global values so that each instance gets its own vectors and
+// maps; other values can't be changed by scripts, and host objects are
+// shared by all instances
+func copyGlobals(dst, src []Value) {
+	copies := make(map[Value]Value)
+	for i, val := range src {
+		dst[i] = copyContainers(val, copies)
+	}
+}
+
+// deep copy of vectors and maps, keeping references between them
+func copyContainers(val Value, copies map[Value]Value) Value {
+	switch v := val.(type) {
+	case *ValueVector:
+		if c, ok := copies[v]; ok {
+			return c
+		}
+		c := &ValueVector{elements: make([]Value, len(v.elements))}
+		copies[v] = c
+		for i, el := range v.elements {
+			c.elements[i] = copyContainers(el, copies)
+		}
+		return c
+
+	case *ValueMap:
+		if c, ok := copies[v]; ok {
+			return c
+		}
+		c := &ValueMap{elements: make([][2]Value, 0, len(v.elements))}
+		copies[v] = c
+		for _, el := range v.elements {
+			c.Put(el[0], copyContainers(el[1], copies))
+		}
+		return c
+	}
+	return val
+}
+
+// global state of a running program.
+//
+// An instance is not safe for concurrent use unless locking is enabled with
+// SetLocking(true) before sharing it; then each call holds the instance lock
+// until it returns, so concurrent calls run one at a time and see each other's
+// changes to globals and containers. Values returned to the host must still
+// not be used while calls are running, and native functions must not call
+// back into the same instance. For parallel execution use one instance per
+// goroutine, created from the same Program.
+type Instance struct {
+	symtab    *symTab
+	env       *Env
+	limits    Limits
+	backend   Backend
+	locking   atomic.Bool
+	mu        sync.Mutex
+	inits     []*globalInit
+	num_inits int
+	entries   []*execExprFuncDef
+	stdout    io.Writer
+	stderr    io.Writer
+	stdin     *bufio.Reader
+}
+
+func newInstance(symtab *symTab, env *Env, limits Limits) *Instance {
+	return &Instance{
+		symtab: symtab,
+		env:    env,
+		limits: limits,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		stdin:  stdin,
+	}
+}
+
+func (inst *Instance) SetOutput(w io.Writer) {
+	defer inst.unlock(inst.lock())
+	inst.stdout = w
+}
+
+func (inst *Instance) SetErrorOutput(w io.Writer) {
+	defer inst.unlock(inst.lock())
+	inst.stderr = w
+}
+
+func (inst *Instance) SetInput(r io.Reader) {
+	defer inst.unlock(inst.lock())
+	if br, ok := r.(*bufio.Reader); ok {
+		inst.stdin = br
+	} else {
+		inst.stdin = bufio.NewReader(r)
+	}
+}
+
+func (inst *Instance) SetLimits(limits Limits) {
+	defer inst.unlock(inst.lock())
+	inst.limits = limits
+}
+
+func (inst *Instance) SetBackend(backend Backend) {
+	defer inst.unlock(inst.lock())
+	inst.backend = backend
+}
+
+// calls running while locking is changed keep the mode they started with
+func (inst *Instance) SetLocking(locking bool) {
+	inst.locking.Store(locking)
+}
+
+// take the instance lock if locking is enabled, returning whether it did
+// for the matching unlock
+func (inst *Instance) lock() bool {
+	if !inst.locking.Load() {
+		return false
+	}
+	inst.mu.Lock()
+	return true
+}
+
+func (inst *Instance) unlock(locked bool) {
+	if locked {
+		inst.mu.Unlock()
+	}
+}
+
+func (inst *Instance) CallFunction(name string, args []Value) (Value, error) {
+	return inst.CallFunctionContext(context.Background(), name, args)
+}
+
+func (inst *Instance) CallFunctionContext(ctx context.Context, name string, args []Value) (Value, error) {
+	defer inst.unlock(inst.lock())
+
+	call_env := newEnv(inst.env, 0)
+	call_env.run = newRunState(ctx, inst)
+	if err := inst.runInits(call_env); err != nil {
+		return nil, err
+	}
+
+	loc := &SrcLoc{"<native>", 0, 0}
+	env_index, var_index := inst.symtab.getVar(name)
+	fun := inst.env.get(env_index, var_index)
+	if fun == nil {
+		return nil, newExecError(loc, fmt.Sprintf("function '%s' not found", name))
+	}
+	if f, ok := fun.(ValueCallable); ok {
+		return f.Call(args, call_env, loc)
+	}
+	return nil, newExecError(loc, fmt.Sprintf("trying to call non-function value of type '%s'", fun.Type()))
+}
+
+func (inst *Instance) Run() (Value, error) {
+	return inst.RunContext(context.Background())
+}
+
+// runs the top level statements of scripts parsed in script mode, in the
+// order the scripts were parsed. A top level 'return' ends the whole run
+// and gives its result, which is null if no statement returns.
+//
+// Every run executes all top level statements again; globals keep the
+// values left by the previous runs and calls, 'var' initializers of
+// functions-only scripts still run only once.
+func (inst *Instance) RunContext(ctx context.Context) (Value, error) {
+	defer inst.unlock(inst.lock())
+
+	call_env := newEnv(inst.env, 0)
+	call_env.run = newRunState(ctx, inst)
+	if err := inst.runInits(call_env); err != nil {
+		return nil, err
+	}
+
+	loc := &SrcLoc{"<native>", 0, 0}
+	for _, entry := range inst.entries {
+		closure := &ValueClosure{
+			fun: entry,
+			env: inst.env,
+		}
+		val, err := closure.Call(nil, call_env, loc)
+		if err != nil {
+			return nil, err
+		}
+		if val != entryEnd {
+			return val, nil
+		}
+	}
+	return NewValueNull(), nil
+}
+
+// run global initializers that haven't run yet
+func (inst *Instance) runInits(env *Env) error {
+	for inst.num_inits < len(inst.inits) {
+		init := inst.inits[inst.num_inits]
+		val, err := init.val.eval(env)
+		if err != nil {
+			return err
+		}
+		inst.env.set(0, init.index, val)
+		inst.num_inits++
+	}
+	return nil
+}
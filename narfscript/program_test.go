@@ -0,0 +1,193 @@
+package narfscript
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+const counterScript = `
+var count = 0;
+var totals = { calls: 0 };
+var hits = [0, 0, 0, 0];
+
+function incr(i) {
+	count = count + 1;
+	totals.calls = totals.calls + 1;
+	hits[i % 4] = hits[i % 4] + 1;
+	var v = [];
+	var n = 0;
+	while (n < 10) {
+		v[n] = n;
+		n = n + 1;
+	}
+	return count;
+}
+
+function get() {
+	return [count, totals.calls, hits[0] + hits[1] + hits[2] + hits[3]];
+}
+`
+
+const numGoroutines = 8
+const numCalls = 200
+
+// call incr() from several goroutines at the same time
+func hammer(t *testing.T, call func(name string, args []Value) (Value, error)) {
+	var wg sync.WaitGroup
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < numCalls; i++ {
+				if _, err := call("incr", []Value{NewValueInt(int64(g + i))}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func checkCounts(t *testing.T, name string, ret Value, err error, want int64) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	vec := ret.(*ValueVector)
+	for i := 0; i < vec.Len(); i++ {
+		val, _ := vec.At(i)
+		if n, _ := AsInt(val); n != want {
+			t.Errorf("%s: got counts %s, want %d", name, ret, want)
+			return
+		}
+	}
+}
+
+func TestLockingSharedInstance(t *testing.T) {
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, counterScript)
+		narf.SetLocking(true)
+		hammer(t, narf.CallFunction)
+		ret, err := narf.CallFunction("get", nil)
+		checkCounts(t, b.name, ret, err, numGoroutines*numCalls)
+	}
+}
+
+func TestLockingSharedGoValues(t *testing.T) {
+	// a container created by the host and shared by all calls
+	shared := NewValueStringMap(map[string]Value{"n": NewValueInt(0)})
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, "function add(m) { m.n = m.n + 1; }")
+		narf.SetLocking(true)
+		shared.Put(NewValueString("n"), NewValueInt(0))
+		hammer(t, func(name string, args []Value) (Value, error) {
+			return narf.CallFunction("add", []Value{shared})
+		})
+		if val, _ := shared.Lookup(NewValueString("n")); val.String() != fmt.Sprint(numGoroutines*numCalls) {
+			t.Errorf("[%s]: got %s, want %d", b.name, val, numGoroutines*numCalls)
+		}
+	}
+}
+
+func TestInstancesInParallel(t *testing.T) {
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, counterScript)
+		prog, err := narf.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < numGoroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				inst := prog.NewInstance()
+				for i := 0; i < numCalls; i++ {
+					if _, err := inst.CallFunction("incr", []Value{NewValueInt(int64(i))}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				ret, err := inst.CallFunction("get", nil)
+				checkCounts(t, b.name, ret, err, numCalls)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// containers added by the host are copied for each instance
+func TestInstancesCopyHostContainers(t *testing.T) {
+	src := "function add() { counts.n = counts.n + 1; counts.list[0] = counts.list[0] + 1; return counts; }"
+	for _, b := range backends {
+		narf := NewNarf()
+		narf.SetBackend(b.backend)
+		list := NewValueVectorOf(NewValueInt(0), nil)
+		counts := NewValueStringMap(map[string]Value{"n": NewValueInt(0), "list": list})
+		list.elements[1] = counts // a cycle, copied as one
+		narf.AddVar("counts", counts)
+		if err := narf.ParseString("test.tst", src); err != nil {
+			t.Fatal(err)
+		}
+		prog, err := narf.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 2; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				inst := prog.NewInstance()
+				var ret Value
+				for i := 0; i < numCalls; i++ {
+					var err error
+					if ret, err = inst.CallFunction("add", nil); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				m := ret.(*ValueMap)
+				n, _ := m.Lookup(NewValueString("n"))
+				l, _ := m.Lookup(NewValueString("list"))
+				first, _ := l.(*ValueVector).At(0)
+				back, _ := l.(*ValueVector).At(1)
+				if n.String() != fmt.Sprint(numCalls) || first.String() != fmt.Sprint(numCalls) || back != m {
+					t.Errorf("[%s]: got n %s, list[0] %s, want %d in a copy keeping the cycle", b.name, n, first, numCalls)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n, _ := counts.Lookup(NewValueString("n")); n.String() != "0" {
+			t.Errorf("[%s]: the host map was changed to %s", b.name, n)
+		}
+	}
+}
+
+// a call keeps the locking mode it started with, even if it's changed
+// while the call runs
+func TestSetLockingDuringCall(t *testing.T) {
+	for _, start := range []bool{false, true} {
+		narf := NewNarf()
+		narf.SetLocking(start)
+		narf.AddGoFunc("set_locking", func(locking bool) {
+			narf.SetLocking(locking)
+		})
+		if err := narf.ParseString("test.tst", "function main(l) { set_locking(l); }"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if _, err := narf.CallFunction("main", []Value{NewValueBool(i%2 == 0 != start)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		narf.SetLocking(true)
+		if _, err := narf.CallFunction("main", []Value{NewValueBool(true)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package narfscript
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+)
+
+// call depth used when no limit is set, so that deep recursion gives an
+// error instead of overflowing the Go stack
+const defaultMaxCallDepth = 10000
+
+// per-call resource limits, a zero value means no limit, except for
+// MaxCallDepth, which is defaultMaxCallDepth when zero
+type Limits struct {
+	MaxSteps       int64 // evaluated expressions and executed statements
+	MaxCallDepth   int   // nested script function calls, defaultMaxCallDepth if zero
+	MaxElements    int   // elements in a single vector or map
+	MaxStringBytes int   // length of a single string
+}
+
+// state of a single call into the interpreter, shared by all envs created during the call
+type runState struct {
+	ctx       context.Context
+	done      <-chan struct{}
+	limits    Limits
+	backend   Backend
+	steps     int64
+	max_steps int64
+	depth     int
+	max_depth int
+	stdout    io.Writer
+	stderr    io.Writer
+	stdin     *bufio.Reader
+}
+
+func newRunState(ctx context.Context, inst *Instance) *runState {
+	run := &runState{
+		ctx:       ctx,
+		done:      ctx.Done(),
+		limits:    inst.limits,
+		backend:   inst.backend,
+		max_steps: math.MaxInt64,
+		max_depth: defaultMaxCallDepth,
+		stdout:    inst.stdout,
+		stderr:    inst.stderr,
+		stdin:     inst.stdin,
+	}
+	if inst.limits.MaxSteps > 0 {
+		run.max_steps = inst.limits.MaxSteps
+	}
+	if inst.limits.MaxCallDepth > 0 {
+		run.max_depth = inst.limits.MaxCallDepth
+	}
+	return run
+}
+
+// count an evaluated node whose location is not known; the step limit is
+// checked by the next node with a location
+func (run *runState) count() {
+	if run != nil {
+		run.steps++
+	}
+}
+
+// count an evaluated node
+func (run *runState) node(loc *SrcLoc) error {
+	if run == nil {
+		return nil
+	}
+	run.steps++
+	if run.steps > run.max_steps {
+		return run.stepLimitError(loc)
+	}
+	return nil
+}
+
+func (run *runState) stepLimitError(loc *SrcLoc) error {
+	return newExecLimitError(loc, ExecErrorStepLimit, fmt.Sprintf("step limit exceeded (%d)", run.limits.MaxSteps))
+}
+
+// count a loop iteration or function call, which also checks for cancellation
+func (run *runState) step(loc *SrcLoc) error {
+	if run == nil {
+		return nil
+	}
+	if err := run.node(loc); err != nil {
+		return err
+	}
+	return run.checkDone(loc)
+}
+
+func (run *runState) checkDone(loc *SrcLoc) error {
+	if run == nil || run.done == nil {
+		return nil
+	}
+	select {
+	case <-run.done:
+		return newCancelError(loc, run.ctx.Err())
+	default:
+		return nil
+	}
+}
+
+func (run *runState) useVM() bool {
+	return run != nil && run.backend == BackendVM
+}
+
+func (run *runState) enterCall(loc *SrcLoc) error {
+	if run == nil {
+		return nil
+	}
+	run.depth++
+	if run.depth > run.max_depth {
+		run.depth--
+		return newExecLimitError(loc, ExecErrorCallDepthLimit, fmt.Sprintf("call depth limit exceeded (%d)", run.max_depth))
+	}
+	return nil
+}
+
+func (run *runState) leaveCall() {
+	if run != nil {
+		run.depth--
+	}
+}
+
+// check a new string before it's used
+func (run *runState) checkString(size int, loc *SrcLoc) error {
+	if run != nil && run.limits.MaxStringBytes > 0 && size > run.limits.MaxStringBytes {
+		return newExecLimitError(loc, ExecErrorStringLimit, fmt.Sprintf("string size limit exceeded (%d bytes)", run.limits.MaxStringBytes))
+	}
+	return nil
+}
+
+// check the number of elements of a container before it's allocated
+func (run *runState) checkElements(kind string, size int, loc *SrcLoc) error {
+	if run != nil && run.limits.MaxElements > 0 && size > run.limits.MaxElements {
+		return newExecLimitError(loc, ExecErrorElementLimit, fmt.Sprintf("%s size limit exceeded (%d elements)", kind, run.limits.MaxElements))
+	}
+	return nil
+}
+
+// check that setting the element of a container doesn't grow it past the
+// limit, before it's changed
+func (run *runState) checkSetIndex(container, index Value, loc *SrcLoc) error {
+	if run == nil || run.limits.MaxElements <= 0 {
+		return nil
+	}
+	switch c := container.(type) {
+	case *ValueVector:
+		if n, ok := index.(ValueNumeric); ok && n.Number() == float64(len(c.elements)) {
+			return run.checkElements("vector", len(c.elements)+1, loc)
+		}
+
+	case *ValueMap:
+		if c.find(index) < 0 {
+			return run.checkElements("map", len(c.elements)+1, loc)
+		}
+	}
+	return nil
+}
+
+// check a value coming from a function call
+func (run *runState) checkSize(val Value, loc *SrcLoc) error {
+	if run == nil {
+		return nil
+	}
+	switch v := val.(type) {
+	case *ValueString:
+		return run.checkString(len(v.str), loc)
+
+	case *ValueVector:
+		return run.checkElements("vector", len(v.elements), loc)
+
+	case *ValueMap:
+		return run.checkElements("map", len(v.elements), loc)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package narfscript
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var backends = []struct {
+	name    string
+	backend Backend
+}{
+	{"tree", BackendTree},
+	{"vm", BackendVM},
+}
+
+func parseTestScript(t testing.TB, backend Backend, src string) *Narf {
+	t.Helper()
+	narf := NewNarf()
+	narf.SetBackend(backend)
+	if err := narf.ParseString("test.tst", src); err != nil {
+		t.Fatal(err)
+	}
+	return narf
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		src    string
+		kind   ExecErrorKind
+	}{
+		{
+			"vector literal",
+			Limits{MaxElements: 3},
+			"function main() { return [[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]]; }",
+			ExecErrorElementLimit,
+		},
+		{
+			"map literal",
+			Limits{MaxElements: 3},
+			"function main() { return { a: 1, b: 2, c: 3, d: 4 }; }",
+			ExecErrorElementLimit,
+		},
+		{
+			"string literal",
+			Limits{MaxStringBytes: 5},
+			"function main() { return [\"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\"]; }",
+			ExecErrorStringLimit,
+		},
+		{
+			"vector append",
+			Limits{MaxElements: 3},
+			"function main() { var v = [1, 2, 3]; v[3] = 4; return v; }",
+			ExecErrorElementLimit,
+		},
+		{
+			"map set",
+			Limits{MaxElements: 3},
+			"function main() { var m = { a: 1, b: 2, c: 3 }; m.d = 4; return m; }",
+			ExecErrorElementLimit,
+		},
+		{
+			"map index set",
+			Limits{MaxElements: 3},
+			"function main() { var m = { a: 1, b: 2, c: 3 }; m[\"d\"] = 4; return m; }",
+			ExecErrorElementLimit,
+		},
+		{
+			"nodes without loops or calls",
+			Limits{MaxSteps: 20},
+			"function main() { var x = 1; x = x + 1; x = x + 1; x = x + 1; x = x + 1; x = x + 1; x = x + 1; x = x + 1; return x; }",
+			ExecErrorStepLimit,
+		},
+		{
+			"call depth",
+			Limits{MaxCallDepth: 10},
+			"function f(n) { return f(n + 1); } function main() { return f(0); }",
+			ExecErrorCallDepthLimit,
+		},
+	}
+
+	for _, b := range backends {
+		for _, test := range tests {
+			narf := parseTestScript(t, b.backend, test.src)
+			narf.SetLimits(test.limits)
+			_, err := narf.CallFunction("main", nil)
+			exec_err, ok := err.(*ExecError)
+			if !ok || exec_err.Kind() != test.kind {
+				t.Errorf("%s [%s]: got error %v, want kind %d", test.name, b.name, err, test.kind)
+			}
+		}
+	}
+}
+
+func TestLimitsNotExceeded(t *testing.T) {
+	src := `function main() {
+		var v = [1, 2];
+		v[2] = 3;
+		v[0] = "abcde";
+		var m = { a: 1, b: 2, c: 3 };
+		m.a = 4;
+		return [v, m];
+	}`
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, src)
+		narf.SetLimits(Limits{MaxElements: 3, MaxStringBytes: 5, MaxSteps: 1000})
+		if _, err := narf.CallFunction("main", nil); err != nil {
+			t.Errorf("[%s]: %v", b.name, err)
+		}
+	}
+}
+
+// limits left at zero keep the default call depth
+func TestPartialLimits(t *testing.T) {
+	src := "function f(n) { return f(n + 1); } function main() { return f(0); }"
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, src)
+		narf.SetLimits(Limits{MaxElements: 10})
+		_, err := narf.CallFunction("main", nil)
+		exec_err, ok := err.(*ExecError)
+		if !ok || exec_err.Kind() != ExecErrorCallDepthLimit {
+			t.Errorf("[%s]: got error %v, want a call depth limit error", b.name, err)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"loop", "function main() { while (true) {} }"},
+		{"deep recursion", "function f(n) { if (n == 0) { while (true) {} } return f(n - 1); } function main() { return f(5000); }"},
+		{"calls", "function fib(n) { if (n < 2) return n; return fib(n - 1) + fib(n - 2); } function main() { return fib(100); }"},
+	}
+	for _, b := range backends {
+		for _, test := range tests {
+			narf := parseTestScript(t, b.backend, test.src)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			_, err := narf.CallFunctionContext(ctx, "main", nil)
+			cancel()
+			if _, ok := err.(*CancelError); !ok || !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("%s [%s]: got error %v, want a CancelError for the deadline", test.name, b.name, err)
+			}
+		}
+	}
+}
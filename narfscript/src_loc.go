@@ -1,7 +1,18 @@
 package narfscript
 
+import (
+	"fmt"
+)
+
 type SrcLoc struct {
-	Filename string
-	Line     int32
-	Col      int32
+	Filename string `json:"file"`
+	Line     int32  `json:"line"`
+	Col      int32  `json:"col"`
+}
+
+func (loc SrcLoc) String() string {
+	if loc.Line == 0 {
+		return loc.Filename
+	}
+	return fmt.Sprintf("%s:%d:%d", loc.Filename, loc.Line, loc.Col)
 }
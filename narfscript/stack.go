@@ -92,7 +92,7 @@ func (s *exprStacks) resolve(stop_prec int32, loc *SrcLoc) error {
 		if op.op.assoc == operatorAssocPrefix {
 			// resolve prefix op
 			if len(s.opn_stack) < 1 {
-				return newParserError(loc, "stack underflow")
+				return newParseError(ParseErrorSyntax, op.loc, fmt.Sprintf("missing operand for '%s'", op.op.ident))
 			}
 			opn := s.popOperand()
 			call := &astExprFuncCall{
@@ -104,7 +104,7 @@ func (s *exprStacks) resolve(stop_prec int32, loc *SrcLoc) error {
 		} else {
 			// resolve binary op
 			if len(s.opn_stack) < 2 {
-				return newParserError(loc, "stack underflow")
+				return newParseError(ParseErrorSyntax, op.loc, fmt.Sprintf("missing operand for '%s'", op.op.ident))
 			}
 			right := s.popOperand()
 			left := s.popOperand()
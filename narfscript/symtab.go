@@ -2,11 +2,18 @@ package narfscript
 
 import (
 	"fmt"
+	"sort"
+	"unicode/utf8"
 )
 
+const maxSuggestions = 3
+
+// names visible in a scope; global names are indices in the global env,
+// names declared in a function are indices in its funcScope.vars
 type symTab struct {
 	parent *symTab
 	names  map[string]int
+	fn     *funcScope // function declaring the names, nil for globals
 }
 
 func newSymTab(parent *symTab, names []string) *symTab {
@@ -14,6 +21,9 @@ func newSymTab(parent *symTab, names []string) *symTab {
 		parent: parent,
 		names:  make(map[string]int, 0),
 	}
+	if parent != nil {
+		symtab.fn = parent.fn
+	}
 	if names != nil {
 		for _, name := range names {
 			symtab.addVar(name)
@@ -22,6 +32,34 @@ func newSymTab(parent *symTab, names []string) *symTab {
 	return symtab
 }
 
+// scope of the parameters of a new function
+func newFuncSymTab(parent *symTab, params []string) *symTab {
+	symtab := &symTab{
+		parent: parent,
+		names:  make(map[string]int, 0),
+		fn: &funcScope{
+			parent: parent.fn,
+			upvals: make(map[*localVar]int),
+		},
+	}
+	for _, name := range params {
+		symtab.declare(name)
+	}
+	return symtab
+}
+
+func (symtab *symTab) clone() *symTab {
+	ret := &symTab{
+		parent: symtab.parent,
+		names:  make(map[string]int, len(symtab.names)),
+		fn:     symtab.fn,
+	}
+	for name, index := range symtab.names {
+		ret.names[name] = index
+	}
+	return ret
+}
+
 func (symtab *symTab) addVar(name string) int {
 	index, ok := symtab.names[name]
 	if ok {
@@ -32,6 +70,42 @@ func (symtab *symTab) addVar(name string) int {
 	return new_index
 }
 
+// declare a local variable of the function, hiding any previous
+// declaration of the same name in this scope
+func (symtab *symTab) declare(name string) *localVar {
+	v := &localVar{
+		name: name,
+		fn:   symtab.fn,
+	}
+	symtab.names[name] = len(symtab.fn.vars)
+	symtab.fn.vars = append(symtab.fn.vars, v)
+	return v
+}
+
+// find the location of a variable at run time; for local variables the
+// location is only known after the function is analyzed, so it's written
+// to *ref by funcScope.finish()
+func (symtab *symTab) resolve(name string, ref *varRef) bool {
+	for t := symtab; t != nil; t = t.parent {
+		index, ok := t.names[name]
+		if !ok {
+			continue
+		}
+		if t.fn == nil {
+			*ref = varRef{varGlobal, index}
+			return true
+		}
+		v := t.fn.vars[index]
+		if v.fn == symtab.fn {
+			symtab.fn.refs = append(symtab.fn.refs, varFixup{ref, v})
+		} else {
+			*ref = varRef{varCell, symtab.fn.upval(v)}
+		}
+		return true
+	}
+	return false
+}
+
 func (symtab *symTab) getVar(name string) (int, int) {
 	index, ok := symtab.names[name]
 	if ok {
@@ -46,6 +120,119 @@ func (symtab *symTab) getVar(name string) (int, int) {
 	return -1, -1
 }
 
+// local variables of a function being analyzed; they're all kept in a
+// single frame, except variables used by inner functions, which are kept
+// in cells shared with the closures
+type funcScope struct {
+	parent   *funcScope
+	vars     []*localVar
+	upvals   map[*localVar]int // cells captured from enclosing functions
+	captures []*localVar       // variable captured by each upval
+	refs     []varFixup
+}
+
+type localVar struct {
+	name     string
+	fn       *funcScope
+	captured bool
+	ref      varRef
+}
+
+// reference to a local variable waiting for its location
+type varFixup struct {
+	ref *varRef
+	v   *localVar
+}
+
+// index in the closure cells of a variable of an enclosing function
+func (fn *funcScope) upval(v *localVar) int {
+	if index, ok := fn.upvals[v]; ok {
+		return index
+	}
+	if v.fn == fn.parent {
+		v.captured = true
+	} else {
+		fn.parent.upval(v)
+	}
+	index := len(fn.captures)
+	fn.captures = append(fn.captures, v)
+	fn.upvals[v] = index
+	return index
+}
+
+// assign locations to the variables and fill in the references to them;
+// the captured cells come first in the frame cells, followed by the
+// cells of captured local variables
+func (fn *funcScope) finish(def *execExprFuncDef) {
+	num_slots := 0
+	num_cells := len(fn.captures)
+	for _, v := range fn.vars {
+		if v.captured {
+			v.ref = varRef{varCell, num_cells}
+			num_cells++
+		} else {
+			v.ref = varRef{varLocal, num_slots}
+			num_slots++
+		}
+	}
+	for _, f := range fn.refs {
+		*f.ref = f.v.ref
+	}
+
+	def.num_slots = num_slots
+	def.num_cells = num_cells
+	def.param_refs = make([]varRef, def.num_params)
+	for i := range def.param_refs {
+		def.param_refs[i] = fn.vars[i].ref
+	}
+	def.captures = make([]varRef, len(fn.captures))
+	for i, v := range fn.captures {
+		if v.fn == fn.parent {
+			fn.parent.refs = append(fn.parent.refs, varFixup{&def.captures[i], v})
+		} else {
+			def.captures[i] = varRef{varCell, fn.parent.upvals[v]}
+		}
+	}
+}
+
+// find the visible names that are most similar to the given name
+func (symtab *symTab) suggest(name string) []string {
+	max_dist := utf8.RuneCountInString(name) / 3
+	if max_dist < 1 {
+		max_dist = 1
+	}
+	dists := make(map[string]int)
+	for t := symtab; t != nil; t = t.parent {
+		for other := range t.names {
+			if _, ok := dists[other]; ok {
+				continue
+			}
+			first, _ := utf8.DecodeRuneInString(other)
+			if !is_ident(first) {
+				continue
+			}
+			if d := editDistance(name, other); d <= max_dist {
+				dists[other] = d
+			}
+		}
+	}
+
+	ret := make([]string, 0, len(dists))
+	for other := range dists {
+		ret = append(ret, other)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if dists[ret[i]] != dists[ret[j]] {
+			return dists[ret[i]] < dists[ret[j]]
+		}
+		return ret[i] < ret[j]
+	})
+	if len(ret) > maxSuggestions {
+		ret = ret[:maxSuggestions]
+	}
+	return ret
+}
+
 func (symtab *symTab) Dump(env *Env) {
 	for name, index := range symtab.names {
 		val := env.get(0, index)
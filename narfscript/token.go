@@ -12,6 +12,7 @@ const (
 	tokenIdent
 	tokenString
 	tokenNumber
+	tokenInt
 	tokenOp
 )
 
@@ -19,8 +20,11 @@ type token struct {
 	tokType tokenType
 	str     string
 	num     float64
+	int_num int64
 	ch      rune
 	loc     SrcLoc
+	end     SrcLoc // position just after the token
+	depth   int    // nesting level of braces where the token appears
 }
 
 func newTokenEOF(loc SrcLoc) *token {
@@ -70,6 +74,14 @@ func newTokenNumber(num float64, loc SrcLoc) *token {
 	}
 }
 
+func newTokenInt(num int64, loc SrcLoc) *token {
+	return &token{
+		tokType: tokenInt,
+		int_num: num,
+		loc:     loc,
+	}
+}
+
 func newTokenOp(op string, loc SrcLoc) *token {
 	return &token{
 		tokType: tokenOp,
@@ -106,6 +118,10 @@ func (t *token) isNumber() bool {
 	return t.tokType == tokenNumber
 }
 
+func (t *token) isInt() bool {
+	return t.tokType == tokenInt
+}
+
 func (t *token) isIdent() bool {
 	return t.tokType == tokenIdent
 }
@@ -128,6 +144,8 @@ func (t *token) String() string {
 		return fmt.Sprintf("string")
 	case tokenNumber:
 		return fmt.Sprintf("'%g'", t.num)
+	case tokenInt:
+		return fmt.Sprintf("'%d'", t.int_num)
 	case tokenOp:
 		return fmt.Sprintf("'%s'", t.str)
 	case tokenPunct:
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"unicode"
 	"unicode/utf8"
@@ -31,6 +30,7 @@ func is_space(ch rune) bool {
 
 type bleepTokenizer struct {
 	in        *bufio.Reader
+	closer    io.Closer
 	keywords  map[string]bool
 	operators []bleepOperator
 	filename  string
@@ -40,10 +40,10 @@ type bleepTokenizer struct {
 	last_col  int32
 }
 
-func newTokenizer(file *os.File, keywords map[string]bool, operators []bleepOperator) *bleepTokenizer {
+func newTokenizer(in io.Reader, filename string, keywords map[string]bool, operators []bleepOperator) *bleepTokenizer {
 	return &bleepTokenizer{
-		in:        bufio.NewReader(file),
-		filename:  file.Name(),
+		in:        bufio.NewReader(in),
+		filename:  filename,
 		line:      1,
 		col:       1,
 		keywords:  keywords,
@@ -51,6 +51,13 @@ func newTokenizer(file *os.File, keywords map[string]bool, operators []bleepOper
 	}
 }
 
+func (t *bleepTokenizer) close() {
+	if t.closer != nil {
+		t.closer.Close()
+		t.closer = nil
+	}
+}
+
 func (t *bleepTokenizer) getRune() (rune, error) {
 	ch, len, err := t.in.ReadRune()
 	if err != nil {
@@ -115,6 +122,14 @@ func (t *bleepTokenizer) isOperator(str []rune) bool {
 }
 
 func (t *bleepTokenizer) Next() *token {
+	tok := t.next()
+	if tok.end.Line == 0 {
+		tok.end = t.getSrcLoc()
+	}
+	return tok
+}
+
+func (t *bleepTokenizer) next() *token {
 	var (
 		first rune
 		loc   SrcLoc
@@ -145,7 +160,7 @@ func (t *bleepTokenizer) Next() *token {
 				break
 			}
 		}
-		return t.Next()
+		return t.next()
 
 	// identifier or keyword
 	case is_ident(first):
@@ -194,14 +209,22 @@ func (t *bleepTokenizer) Next() *token {
 				break
 			}
 		}
+		// integers too large for an int are read as floats
+		if int_num, err := strconv.ParseInt(string(buf), 10, 64); err == nil {
+			return newTokenInt(int_num, loc)
+		}
 		num, err := strconv.ParseFloat(string(buf), 64)
 		if err != nil {
 			return t.toTokenError(err)
 		}
-		return newTokenNumber(num, loc)
+		tok := newTokenNumber(num, loc)
+		tok.str = string(buf)
+		return tok
 
 	// string
 	case first == '"':
+		// an invalid escape is reported after reading the whole string
+		var bad_escape *token
 		for {
 			ch, err := t.getRune()
 			if err != nil {
@@ -214,6 +237,7 @@ func (t *bleepTokenizer) Next() *token {
 				break
 			}
 			if ch == '\\' {
+				esc_loc := SrcLoc{t.filename, t.last_line, t.last_col}
 				next, err := t.getRune()
 				if err != nil {
 					if err == io.EOF {
@@ -235,14 +259,20 @@ func (t *bleepTokenizer) Next() *token {
 				case 't':
 					buf = append(buf, '\t')
 				default:
-					return newTokenError(
-						fmt.Sprintf("invalid character escape: '\\%c'", next),
-						t.getSrcLoc())
+					if bad_escape == nil {
+						bad_escape = newTokenError(
+							fmt.Sprintf("invalid character escape: '\\%c'", next),
+							esc_loc)
+						bad_escape.end = t.getSrcLoc()
+					}
 				}
 			} else {
 				buf = append(buf, ch)
 			}
 		}
+		if bad_escape != nil {
+			return bad_escape
+		}
 		return newTokenString(string(buf), loc)
 
 	case first == ',' || first == ';' || first == ':' ||
@@ -3,6 +3,7 @@ package narfscript
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 )
 
@@ -10,11 +11,15 @@ var bleepNull ValueNull = ValueNull{}
 var bleepTrue ValueBool = ValueBool{true}
 var bleepFalse ValueBool = ValueBool{false}
 var bleepNumbers []ValueNumber = make([]ValueNumber, 10)
+var bleepInts []ValueInt = make([]ValueInt, 256)
 
 func init() {
 	for i := 0; i < len(bleepNumbers); i++ {
 		bleepNumbers[i] = ValueNumber{float64(i)}
 	}
+	for i := 0; i < len(bleepInts); i++ {
+		bleepInts[i] = ValueInt{int64(i)}
+	}
 }
 
 type Value interface {
@@ -41,6 +46,45 @@ type ValueContainer interface {
 	Set(Value, Value, *SrcLoc) error
 }
 
+type NativeMethod func(ValueObject, []Value, *Env, *SrcLoc) (Value, error)
+
+// host object with fields and methods reachable through 'obj.name'
+type ValueObject interface {
+	Type() string
+	String() string
+	GetField(string, *SrcLoc) (Value, error)
+	SetField(string, Value, *SrcLoc) error
+	Method(string) (NativeMethod, bool)
+}
+
+func AsNumber(val Value) (float64, bool) {
+	if n, ok := val.(ValueNumeric); ok {
+		return n.Number(), true
+	}
+	return 0, false
+}
+
+func AsInt(val Value) (int64, bool) {
+	if n, ok := val.(*ValueInt); ok {
+		return n.num, true
+	}
+	return 0, false
+}
+
+func AsString(val Value) (string, bool) {
+	if s, ok := val.(*ValueString); ok {
+		return s.str, true
+	}
+	return "", false
+}
+
+func AsBool(val Value) (bool, bool) {
+	if b, ok := val.(*ValueBool); ok {
+		return b.val, true
+	}
+	return false, false
+}
+
 // null
 type ValueNull struct {
 }
@@ -102,6 +146,42 @@ func (v *ValueNumber) Number() float64 {
 	return v.num
 }
 
+// integer
+type ValueInt struct {
+	num int64
+}
+
+func NewValueInt(num int64) *ValueInt {
+	if num >= 0 && num < int64(len(bleepInts)) {
+		return &bleepInts[num]
+	}
+	return &ValueInt{num}
+}
+
+func (v *ValueInt) Type() string {
+	return "int"
+}
+
+func (v *ValueInt) String() string {
+	return fmt.Sprintf("%d", v.num)
+}
+
+func (v *ValueInt) Number() float64 {
+	return float64(v.num)
+}
+
+func (v *ValueInt) Int() int64 {
+	return v.num
+}
+
+// the integer with exactly the value of f, if there is one
+func floatToInt64(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
 // string
 type ValueString struct {
 	str string
@@ -121,12 +201,13 @@ func (v *ValueString) String() string {
 
 // closure
 type ValueClosure struct {
-	fun *execExprFuncDef
-	env *Env
+	fun   *execExprFuncDef
+	env   *Env
+	cells []*valueCell
 }
 
 func (v *ValueClosure) String() string {
-	return "<closure>"
+	return fmt.Sprintf("<closure %s>", v.fun.name)
 }
 
 func (v *ValueClosure) Type() string {
@@ -140,23 +221,31 @@ func (v *ValueClosure) Call(args []Value, env *Env, loc *SrcLoc) (Value, error)
 			fmt.Sprintf("invalid number of arguments: expected %d, got %d", v.fun.num_params, len(args)))
 	}
 
-	// create new env with arguments
-	new_env := newEnv(v.env, v.fun.num_params)
+	// create new frame with arguments, running in the caller's state
+	new_env := newEnv(v.env, v.fun.num_slots)
+	if env != nil {
+		new_env.run = env.run
+	}
+	if v.fun.num_cells > 0 {
+		new_env.cells = make([]*valueCell, v.fun.num_cells)
+		copy(new_env.cells, v.cells)
+	}
 	for i, arg := range args {
-		new_env.set(0, i, arg)
+		new_env.declare(v.fun.param_refs[i], arg)
 	}
 
 	// run function body
-	err := v.fun.body.exec(new_env)
+	if err := new_env.run.enterCall(loc); err != nil {
+		return nil, err
+	}
+	ret, err := v.fun.call(new_env)
+	new_env.run.leaveCall()
 	if err != nil {
-		if ret, ok := err.(*returnError); ok {
-			return ret.retval, nil
+		if exec_err, ok := err.(*ExecError); ok {
+			return nil, exec_err.withFrame(v.fun.name, loc, new_env.run)
 		}
 		return nil, err
 	}
-
-	// return
-	ret := NewValueNull()
 	return ret, nil
 }
 
@@ -190,6 +279,10 @@ func NewValueVector(elements []Value) *ValueVector {
 	return &ValueVector{elements}
 }
 
+func NewValueVectorOf(elements ...Value) *ValueVector {
+	return &ValueVector{append([]Value(nil), elements...)}
+}
+
 func (v *ValueVector) Type() string {
 	return "vector"
 }
@@ -207,6 +300,22 @@ func (v *ValueVector) String() string {
 	return strings.Join(ret, "")
 }
 
+func (v *ValueVector) Len() int {
+	return len(v.elements)
+}
+
+// the element at i, or false if i is out of range
+func (v *ValueVector) At(i int) (Value, bool) {
+	if i < 0 || i >= len(v.elements) {
+		return nil, false
+	}
+	return v.elements[i], true
+}
+
+func (v *ValueVector) Append(vals ...Value) {
+	v.elements = append(v.elements, vals...)
+}
+
 func (v *ValueVector) Get(index Value, loc *SrcLoc) (Value, error) {
 	if n, ok := index.(ValueNumeric); ok {
 		f := n.Number()
@@ -244,11 +353,51 @@ func (v *ValueVector) Set(index Value, val Value, loc *SrcLoc) error {
 
 // map
 type ValueMap struct {
-	elements [][2]Value
+	elements [][2]Value          // in insertion order
+	index    map[interface{}]int // position of each key, built once the map grows
+}
+
+// maps with fewer elements are searched without an index
+const mapIndexMin = 8
+
+// key with the equality of valuesAreEqual: numbers by value, strings by
+// content and everything else by identity
+func mapKey(key Value) interface{} {
+	switch k := key.(type) {
+	case *ValueInt:
+		return k.num
+	case ValueNumeric:
+		// integral floats use the key of the equal int
+		if i, ok := floatToInt64(k.Number()); ok {
+			return i
+		}
+		return k.Number()
+	case *ValueString:
+		return k.str
+	}
+	return key
 }
 
 func NewValueMap(elements [][2]Value) *ValueMap {
-	return &ValueMap{elements}
+	ret := &ValueMap{elements: make([][2]Value, 0, len(elements))}
+	for _, el := range elements {
+		ret.Put(el[0], el[1])
+	}
+	return ret
+}
+
+func NewValueStringMap(elements map[string]Value) *ValueMap {
+	keys := make([]string, 0, len(elements))
+	for key := range elements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ret := &ValueMap{elements: make([][2]Value, 0, len(elements))}
+	for _, key := range keys {
+		ret.Put(NewValueString(key), elements[key])
+	}
+	return ret
 }
 
 func (v *ValueMap) Type() string {
@@ -268,22 +417,96 @@ func (v *ValueMap) String() string {
 	return strings.Join(ret, "")
 }
 
-func (v *ValueMap) Get(key Value, loc *SrcLoc) (Value, error) {
+func (v *ValueMap) Len() int {
+	return len(v.elements)
+}
+
+func (v *ValueMap) Keys() []Value {
+	ret := make([]Value, 0, len(v.elements))
 	for _, el := range v.elements {
-		if valuesAreEqual(key, el[0]) {
-			return el[1], nil
-		}
+		ret = append(ret, el[0])
 	}
-	return NewValueNull(), nil
+	return ret
 }
 
-func (v *ValueMap) Set(key Value, val Value, loc *SrcLoc) error {
+func (v *ValueMap) find(key Value) int {
+	if v.index != nil {
+		if i, ok := v.index[mapKey(key)]; ok {
+			return i
+		}
+		return -1
+	}
 	for i, el := range v.elements {
 		if valuesAreEqual(key, el[0]) {
-			v.elements[i][1] = val
-			return nil
+			return i
 		}
 	}
+	return -1
+}
+
+// the value of key, or false if the map doesn't have it
+func (v *ValueMap) Lookup(key Value) (Value, bool) {
+	if i := v.find(key); i >= 0 {
+		return v.elements[i][1], true
+	}
+	return nil, false
+}
+
+// set the value of key, adding it at the end if it's new
+func (v *ValueMap) Put(key Value, val Value) {
+	if i := v.find(key); i >= 0 {
+		v.elements[i][1] = val
+		return
+	}
 	v.elements = append(v.elements, [2]Value{key, val})
+	if v.index != nil {
+		v.index[mapKey(key)] = len(v.elements) - 1
+	} else if len(v.elements) >= mapIndexMin {
+		v.reindex(0)
+	}
+}
+
+func (v *ValueMap) Delete(key Value) bool {
+	i := v.find(key)
+	if i < 0 {
+		return false
+	}
+	v.elements = append(v.elements[:i], v.elements[i+1:]...)
+	if v.index != nil {
+		delete(v.index, mapKey(key))
+		v.reindex(i)
+	}
+	return true
+}
+
+// update the index for the elements from position start
+func (v *ValueMap) reindex(start int) {
+	if v.index == nil {
+		v.index = make(map[interface{}]int, len(v.elements))
+	}
+	for i := start; i < len(v.elements); i++ {
+		v.index[mapKey(v.elements[i][0])] = i
+	}
+}
+
+// calls fn for each element in insertion order until fn returns false
+func (v *ValueMap) Range(fn func(key, val Value) bool) {
+	for _, el := range v.elements {
+		if !fn(el[0], el[1]) {
+			return
+		}
+	}
+}
+
+// the value of key, or null if the map doesn't have it
+func (v *ValueMap) Get(key Value, loc *SrcLoc) (Value, error) {
+	if val, ok := v.Lookup(key); ok {
+		return val, nil
+	}
+	return NewValueNull(), nil
+}
+
+func (v *ValueMap) Set(key Value, val Value, loc *SrcLoc) error {
+	v.Put(key, val)
 	return nil
 }
@@ -0,0 +1,166 @@
+package narfscript
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// a container implemented by the host
+type testRecord struct {
+	fields map[string]Value
+}
+
+func (r *testRecord) Type() string   { return "record" }
+func (r *testRecord) String() string { return "<record>" }
+
+func (r *testRecord) Get(key Value, loc *SrcLoc) (Value, error) {
+	name, _ := AsString(key)
+	if val, ok := r.fields[name]; ok {
+		return val, nil
+	}
+	return NewValueNull(), nil
+}
+
+func (r *testRecord) Set(key Value, val Value, loc *SrcLoc) error {
+	name, _ := AsString(key)
+	r.fields[name] = val
+	return nil
+}
+
+func TestHostContainer(t *testing.T) {
+	rec := &testRecord{map[string]Value{"x": NewValueInt(20)}}
+	for _, b := range backends {
+		narf := parseTestScript(t, b.backend, "function main(r) { r.y = r.x + 1; r[\"z\"] = r.y * 2; return r.z; }")
+		ret, err := narf.CallFunction("main", []Value{rec})
+		if err != nil {
+			t.Fatalf("[%s]: %v", b.name, err)
+		}
+		if n, _ := AsInt(ret); n != 42 {
+			t.Errorf("[%s]: got %s, want 42", b.name, ret)
+		}
+	}
+}
+
+func TestVectorAccessors(t *testing.T) {
+	vec := NewValueVectorOf(NewValueInt(1), NewValueString("a"))
+	vec.Append(NewValueBool(true))
+	if vec.Len() != 3 {
+		t.Fatalf("got length %d, want 3", vec.Len())
+	}
+	if val, ok := vec.At(1); !ok || val.String() != `"a"` {
+		t.Errorf("At(1) = %v, %t", val, ok)
+	}
+	for _, i := range []int{-1, 3} {
+		if val, ok := vec.At(i); ok {
+			t.Errorf("At(%d) = %v, want out of range", i, val)
+		}
+	}
+	if _, err := vec.Get(NewValueInt(3), &SrcLoc{}); err == nil {
+		t.Errorf("Get(3) didn't fail")
+	}
+}
+
+func TestMapAccessors(t *testing.T) {
+	m := NewValueStringMap(map[string]Value{"b": NewValueInt(2), "a": NewValueInt(1)})
+	m.Put(NewValueInt(1), NewValueString("one"))
+	if val, ok := m.Lookup(NewValueNumber(1)); !ok || val.String() != `"one"` {
+		t.Errorf("Lookup(1.0) = %v, %t", val, ok)
+	}
+	if _, ok := m.Lookup(NewValueString("c")); ok {
+		t.Errorf("Lookup(\"c\") found a value")
+	}
+	if val, err := m.Get(NewValueString("c"), &SrcLoc{}); err != nil || val != NewValueNull() {
+		t.Errorf("Get(\"c\") = %v, %v, want null", val, err)
+	}
+	if err := m.Set(NewValueString("c"), NewValueInt(3), &SrcLoc{}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Delete(NewValueString("a")) || m.Delete(NewValueString("a")) {
+		t.Errorf("Delete(\"a\") didn't remove the key once")
+	}
+	var keys []string
+	m.Range(func(key, val Value) bool {
+		keys = append(keys, key.String())
+		return true
+	})
+	if got := len(keys); got != m.Len() || keys[0] != `"b"` || keys[2] != `"c"` {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+// an object implemented by the host
+type testCounter struct {
+	count int64
+	step  int64
+}
+
+func (c *testCounter) Type() string   { return "counter" }
+func (c *testCounter) String() string { return "<counter>" }
+
+func (c *testCounter) GetField(name string, loc *SrcLoc) (Value, error) {
+	switch name {
+	case "count":
+		return NewValueInt(c.count), nil
+	case "step":
+		return NewValueInt(c.step), nil
+	}
+	return nil, newExecError(loc, fmt.Sprintf("counter has no field '%s'", name))
+}
+
+func (c *testCounter) SetField(name string, val Value, loc *SrcLoc) error {
+	n, ok := AsInt(val)
+	if name != "step" || !ok {
+		return newExecError(loc, fmt.Sprintf("can't set field '%s' of counter", name))
+	}
+	c.step = n
+	return nil
+}
+
+func (c *testCounter) Method(name string) (NativeMethod, bool) {
+	if name != "incr" {
+		return nil, false
+	}
+	return func(obj ValueObject, args []Value, env *Env, loc *SrcLoc) (Value, error) {
+		c := obj.(*testCounter)
+		times := int64(1)
+		if len(args) > 0 {
+			times, _ = AsInt(args[0])
+		}
+		c.count += times * c.step
+		return NewValueInt(c.count), nil
+	}, true
+}
+
+func TestHostObject(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+		err  string
+	}{
+		{src: "c.incr(); return c.incr(2);", want: "3"},
+		{src: "c.step = 10; c.incr(); return [c.count, c.step];", want: "[ 10, 10 ]"},
+		{src: "var f = c.incr; f(); f(); return c.count;", want: "2"},
+		{src: "return c.size;", err: "counter has no field 'size'"},
+		{src: "return c.reset();", err: "counter has no field 'reset'"},
+		{src: "c.count = 1;", err: "can't set field 'count' of counter"},
+		{src: "c.step = \"x\";", err: "can't set field 'step' of counter"},
+	}
+	for _, b := range backends {
+		for _, test := range tests {
+			narf := parseTestScript(t, b.backend, "function main(c) { "+test.src+" }")
+			ret, err := narf.CallFunction("main", []Value{&testCounter{step: 1}})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("[%s] %s: got error %v, want %q", b.name, test.src, err, test.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("[%s] %s: %v", b.name, test.src, err)
+			} else if ret.String() != test.want {
+				t.Errorf("[%s] %s: got %s, want %s", b.name, test.src, ret, test.want)
+			}
+		}
+	}
+}
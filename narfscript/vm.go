@@ -0,0 +1,932 @@
+package narfscript
+
+import (
+	"fmt"
+	"math"
+)
+
+// Backend selects how script functions are executed
+type Backend int
+
+const (
+	BackendTree Backend = iota // walk the analyzed tree
+	BackendVM                  // run bytecode compiled from the analyzed tree
+)
+
+type vmOp uint8
+
+const (
+	vmNop            vmOp = iota // only counts nodes
+	vmConst                      // push consts[a]
+	vmString                     // push the string consts[a]
+	vmLoadLocal                  // push frame value a
+	vmLoadCell                   // push the value of frame cell a
+	vmLoadGlobal                 // push global a
+	vmFolded                     // push the value of folds[a] and skip the code computing it, unless its globals changed
+	vmGuards                     // go to guards[a].orig unless the globals of guards[a] hold
+	vmArith                      // push the value of ariths[a] and skip the code computing it, if it can be computed
+	vmStoreLocal                 // set frame value a to the top of the stack
+	vmStoreCell                  // set the value of frame cell a to the top of the stack
+	vmStoreGlobal                // set global a to the top of the stack
+	vmSetLocal                   // pop a value into frame value a
+	vmNewCell                    // pop a value into a new frame cell a
+	vmPop                        // drop the top of the stack
+	vmJump                       // go to a
+	vmJumpIfFalse                // pop a value, go to a if it's false
+	vmJumpIfTrue                 // pop a value, go to a if it's true
+	vmToBool                     // replace the top of the stack with its truth value
+	vmNot                        // replace the top of the stack with its negated truth value
+	vmClosure                    // push a closure of funcs[a]
+	vmVector                     // pop a elements, push a vector with them
+	vmMap                        // pop a key/value pairs, push a map with them
+	vmIndex                      // pop index and container, push the element
+	vmCheckContainer             // check that the top of the stack is a container
+	vmSetIndex                   // pop value, index and container, set the element, push the value
+	vmGetField                   // pop an object, push its field consts[a]
+	vmSetField                   // pop value and object, set field consts[a], push the value
+	vmMethod                     // pop an object, push its method consts[a]
+	vmCheckCallable              // check that the top of the stack can be called
+	vmCall                       // pop a arguments and a function, push the result of the call
+	vmOperatorStart              // push nil if operators[a] is built-in, its checked function otherwise
+	vmOperator                   // pop the arguments of operators[a] and nil or a function, push the result
+	vmStep                       // count a loop iteration or call, checking for cancellation
+	vmReturn                     // return the top of the stack
+)
+
+type vmInstr struct {
+	op    vmOp
+	nodes uint8 // evaluated nodes counted when the instruction runs
+	check bool  // check the step limit, done by instructions with a location
+	a     int32
+}
+
+// compiled body of a function
+type vmCode struct {
+	instrs    []vmInstr
+	locs      []SrcLoc // location of each instruction
+	consts    []Value
+	funcs     []*execExprFuncDef
+	operators []*execExprOperator
+	folds     []*vmFold
+	guards    []*vmGuard
+	ariths    []*vmArithExpr
+	names     map[int]string // variable names of loads and stores, for error messages
+}
+
+// folded value and the end of the code computing it again
+type vmFold struct {
+	expr *execExprFolded
+	end  int
+}
+
+// globals a statement selected by the optimizer depends on, and the start
+// of the code running the original statement
+type vmGuard struct {
+	guards []execGuard
+	orig   int
+}
+
+// bytecode of the function body, compiled on first use
+func (e *execExprFuncDef) bytecode() *vmCode {
+	e.code_once.Do(func() {
+		e.code = compileFunc(e)
+	})
+	return e.code
+}
+
+// -------------------------------------------------------------------
+// arithmetic
+
+// built-in operators on variables and constants, computed in a single
+// instruction without allocating values for the intermediate results.
+// It's followed by the code computing the same with values, which runs
+// instead when an operator has been rebound or a variable doesn't hold
+// an int or a float.
+type vmArithExpr struct {
+	code      []vmArithInstr // in postfix order
+	operators []*execExprOperator
+	nodes     int64 // evaluated nodes of the expression
+	loc       SrcLoc
+	end       int
+}
+
+type vmArithKind uint8
+
+const (
+	vmArithConst vmArithKind = iota
+	vmArithLocal
+	vmArithCell
+	vmArithGlobal
+	vmArithOp
+)
+
+type vmArithInstr struct {
+	kind  vmArithKind
+	op    builtinOp
+	index int32
+	num   opNum
+}
+
+// largest stack of intermediate results
+const vmArithDepth = 8
+
+// returns nil if the expression can't be computed as arithmetic
+func newVMArith(e *execExprOperator) *vmArithExpr {
+	arith := &vmArithExpr{loc: e.call.loc}
+	if depth, ok := arith.add(e); !ok || depth > vmArithDepth {
+		return nil
+	}
+	return arith
+}
+
+// add the code of an expression, returning the stack size it needs
+func (a *vmArithExpr) add(expr execExpression) (int, bool) {
+	switch e := expr.(type) {
+	case *execExprConst:
+		num, ok := valueToOpNum(e.val)
+		if !ok {
+			return 0, false
+		}
+		a.code = append(a.code, vmArithInstr{kind: vmArithConst, num: num})
+
+	case *execExprIdent:
+		kind := vmArithGlobal
+		switch e.ref.kind {
+		case varLocal:
+			kind = vmArithLocal
+		case varCell:
+			kind = vmArithCell
+		}
+		a.code = append(a.code, vmArithInstr{kind: kind, index: int32(e.ref.index)})
+
+	case *execExprOperator:
+		depth := 0
+		a.operators = append(a.operators, e)
+		for i, arg := range e.call.args {
+			arg_depth, ok := a.add(arg)
+			if !ok {
+				return 0, false
+			}
+			depth = max(depth, i+arg_depth)
+		}
+		a.code = append(a.code, vmArithInstr{kind: vmArithOp, op: e.op})
+		a.nodes++
+		return depth, true
+
+	default:
+		return 0, false
+	}
+	a.nodes++
+	return 1, true
+}
+
+func (a *vmArithExpr) eval(locals []Value, cells []*valueCell, globals []Value) (Value, bool) {
+	for _, op := range a.operators {
+		if !op.isBuiltinIn(globals) {
+			return nil, false
+		}
+	}
+
+	var stack [vmArithDepth]opNum
+	sp := 0
+	for i := range a.code {
+		in := &a.code[i]
+		var val Value
+		switch in.kind {
+		case vmArithConst:
+			stack[sp] = in.num
+			sp++
+			continue
+
+		case vmArithLocal:
+			val = locals[in.index]
+
+		case vmArithCell:
+			cell := cells[in.index]
+			if cell == nil {
+				return nil, false
+			}
+			val = cell.val
+
+		case vmArithGlobal:
+			val = globals[in.index]
+
+		case vmArithOp:
+			if in.op == opNeg {
+				ret, ok := opNeg.applyNum(stack[sp-1], opNum{})
+				if !ok {
+					return nil, false
+				}
+				stack[sp-1] = ret
+				continue
+			}
+			ret, ok := in.op.applyNum(stack[sp-2], stack[sp-1])
+			if !ok {
+				return nil, false
+			}
+			sp--
+			stack[sp-1] = ret
+			continue
+		}
+
+		num, ok := valueToOpNum(val)
+		if !ok {
+			return nil, false
+		}
+		stack[sp] = num
+		sp++
+	}
+	return stack[0].value(), true
+}
+
+// -------------------------------------------------------------------
+// compiler
+
+type vmLoop struct {
+	top    int   // start of each iteration
+	breaks []int // jumps to the end of the loop
+}
+
+type vmCompiler struct {
+	code     *vmCode
+	loops    []*vmLoop
+	nodes    int  // nodes counted by the next instruction
+	no_arith bool // compiling the code run when arithmetic can't be used
+	numbers  map[float64]int32
+	ints     map[int64]int32
+	strings  map[string]int32
+}
+
+func compileFunc(def *execExprFuncDef) *vmCode {
+	c := &vmCompiler{
+		code: &vmCode{
+			names: make(map[int]string),
+		},
+		numbers: make(map[float64]int32),
+		ints:    make(map[int64]int32),
+		strings: make(map[string]int32),
+	}
+	c.compileStmt(def.body)
+	c.emit(vmConst, c.addConst(NewValueNull()), SrcLoc{})
+	c.emit(vmReturn, 0, SrcLoc{})
+	return c.code
+}
+
+// count a node evaluated when the next instruction runs
+func (c *vmCompiler) count() {
+	c.nodes++
+}
+
+func (c *vmCompiler) emit(op vmOp, a int32, loc SrcLoc) int {
+	for c.nodes > math.MaxUint8 {
+		c.nodes -= math.MaxUint8
+		c.code.instrs = append(c.code.instrs, vmInstr{vmNop, math.MaxUint8, false, 0})
+		c.code.locs = append(c.code.locs, SrcLoc{})
+	}
+	c.code.instrs = append(c.code.instrs, vmInstr{op, uint8(c.nodes), loc != SrcLoc{}, a})
+	c.code.locs = append(c.code.locs, loc)
+	c.nodes = 0
+	return len(c.code.instrs) - 1
+}
+
+// the position of the next instruction as a jump target; nodes counted
+// before are left behind, so they're not counted by jumps to it
+func (c *vmCompiler) label() int {
+	if c.nodes > 0 {
+		c.emit(vmNop, 0, SrcLoc{})
+	}
+	return len(c.code.instrs)
+}
+
+// make the jump at pc go to the next instruction
+func (c *vmCompiler) patch(pc int) {
+	c.code.instrs[pc].a = int32(c.label())
+}
+
+func (c *vmCompiler) addConst(val Value) int32 {
+	c.code.consts = append(c.code.consts, val)
+	return int32(len(c.code.consts) - 1)
+}
+
+func (c *vmCompiler) addNumber(num float64) int32 {
+	if index, ok := c.numbers[num]; ok {
+		return index
+	}
+	index := c.addConst(NewValueNumber(num))
+	c.numbers[num] = index
+	return index
+}
+
+func (c *vmCompiler) addInt(num int64) int32 {
+	if index, ok := c.ints[num]; ok {
+		return index
+	}
+	index := c.addConst(NewValueInt(num))
+	c.ints[num] = index
+	return index
+}
+
+func (c *vmCompiler) addString(str string) int32 {
+	if index, ok := c.strings[str]; ok {
+		return index
+	}
+	index := c.addConst(NewValueString(str))
+	c.strings[str] = index
+	return index
+}
+
+// statements count as nodes like they do in the tree interpreter, except
+// for 'while', which counts a step for each iteration
+func (c *vmCompiler) compileStmt(stmt execStatement) {
+	switch s := stmt.(type) {
+	case *execStmtBlock:
+		c.count()
+		for _, sub := range s.stmts {
+			c.compileStmt(sub)
+		}
+
+	case *execStmtVar:
+		c.count()
+		c.compileExpr(s.val)
+		if s.ref.kind == varCell {
+			c.emit(vmNewCell, int32(s.ref.index), SrcLoc{})
+		} else if s.ref.kind == varLocal {
+			c.emit(vmSetLocal, int32(s.ref.index), SrcLoc{})
+		} else {
+			c.emitStore(s.ref, s.name, SrcLoc{})
+			c.emit(vmPop, 0, SrcLoc{})
+		}
+
+	case *execStmtIf:
+		c.count()
+		c.compileExpr(s.test_expr)
+		jump_false := c.emit(vmJumpIfFalse, 0, SrcLoc{})
+		c.compileStmt(s.true_stmt)
+		if s.false_stmt == nil {
+			c.patch(jump_false)
+			break
+		}
+		jump_end := c.emit(vmJump, 0, SrcLoc{})
+		c.patch(jump_false)
+		c.compileStmt(s.false_stmt)
+		c.patch(jump_end)
+
+	case *execStmtFolded:
+		guard := &vmGuard{guards: s.guards}
+		c.code.guards = append(c.code.guards, guard)
+		c.emit(vmGuards, int32(len(c.code.guards)-1), SrcLoc{})
+		c.count()
+		if s.stmt != nil {
+			c.compileStmt(s.stmt)
+		}
+		jump_end := c.emit(vmJump, 0, SrcLoc{})
+		guard.orig = c.label()
+		c.compileStmt(s.orig)
+		c.patch(jump_end)
+
+	case *execStmtWhile:
+		loop := &vmLoop{top: c.label()}
+		c.loops = append(c.loops, loop)
+		c.count()
+		c.emit(vmStep, 0, s.loc)
+		c.compileExpr(s.test_expr)
+		jump_end := c.emit(vmJumpIfFalse, 0, SrcLoc{})
+		c.compileStmt(s.stmt)
+		c.emit(vmJump, int32(loop.top), SrcLoc{})
+		c.patch(jump_end)
+		for _, pc := range loop.breaks {
+			c.patch(pc)
+		}
+		c.loops = c.loops[:len(c.loops)-1]
+
+	case *execStmtReturn:
+		c.count()
+		if s.retval == nil {
+			c.emit(vmConst, c.addConst(NewValueNull()), SrcLoc{})
+		} else {
+			c.compileExpr(s.retval)
+		}
+		c.emit(vmReturn, 0, SrcLoc{})
+
+	case *execStmtBreak:
+		c.count()
+		loop := c.loops[len(c.loops)-1]
+		loop.breaks = append(loop.breaks, c.emit(vmJump, 0, SrcLoc{}))
+
+	case *execStmtExpression:
+		c.count()
+		if assign, ok := s.e.(*execExprVarAssignment); ok && assign.ref.kind == varLocal {
+			c.count()
+			c.compileExpr(assign.val)
+			c.emit(vmSetLocal, int32(assign.ref.index), assign.loc)
+			break
+		}
+		c.compileExpr(s.e)
+		c.emit(vmPop, 0, SrcLoc{})
+
+	default:
+		panic(fmt.Sprintf("vm: can't compile statement of type %T", stmt))
+	}
+}
+
+func (c *vmCompiler) emitStore(ref varRef, name string, loc SrcLoc) {
+	op := vmStoreGlobal
+	switch ref.kind {
+	case varLocal:
+		op = vmStoreLocal
+	case varCell:
+		op = vmStoreCell
+	}
+	pc := c.emit(op, int32(ref.index), loc)
+	c.code.names[pc] = name
+}
+
+func (c *vmCompiler) compileExprs(exprs []execExpression) {
+	for _, e := range exprs {
+		c.compileExpr(e)
+	}
+}
+
+func (c *vmCompiler) compileExpr(expr execExpression) {
+	c.count()
+	switch e := expr.(type) {
+	case *execExprConst:
+		c.emit(vmConst, c.addConst(e.val), SrcLoc{})
+
+	case *execExprNumber:
+		c.emit(vmConst, c.addNumber(e.num), SrcLoc{})
+
+	case *execExprInt:
+		c.emit(vmConst, c.addInt(e.num), SrcLoc{})
+
+	case *execExprString:
+		c.emit(vmString, c.addConst(e.val), e.loc)
+
+	case *execExprIdent:
+		op := vmLoadGlobal
+		switch e.ref.kind {
+		case varLocal:
+			op = vmLoadLocal
+		case varCell:
+			op = vmLoadCell
+		}
+		pc := c.emit(op, int32(e.ref.index), e.loc)
+		c.code.names[pc] = e.name
+
+	case *execExprFolded:
+		fold := &vmFold{expr: e}
+		c.code.folds = append(c.code.folds, fold)
+		c.emit(vmFolded, int32(len(c.code.folds)-1), SrcLoc{})
+		c.compileExpr(e.expr)
+		fold.end = c.label()
+
+	case *execExprVarAssignment:
+		c.compileExpr(e.val)
+		c.emitStore(e.ref, e.name, e.loc)
+
+	case *execExprFuncDef:
+		c.code.funcs = append(c.code.funcs, e)
+		c.emit(vmClosure, int32(len(c.code.funcs)-1), SrcLoc{})
+
+	case *execExprVectorLiteral:
+		c.compileExprs(e.elements)
+		c.emit(vmVector, int32(len(e.elements)), e.loc)
+
+	case *execExprMapLiteral:
+		for _, el := range e.elements {
+			c.compileExpr(el[0])
+			c.compileExpr(el[1])
+		}
+		c.emit(vmMap, int32(len(e.elements)), e.loc)
+
+	case *execExprElementIndex:
+		c.compileExpr(e.container)
+		c.compileExpr(e.index)
+		c.emit(vmIndex, 0, e.loc)
+
+	case *execExprContainerSet:
+		c.compileExpr(e.container)
+		c.emit(vmCheckContainer, 0, e.loc)
+		c.compileExpr(e.index)
+		c.compileExpr(e.val)
+		c.emit(vmSetIndex, 0, e.loc)
+
+	case *execExprDot:
+		c.compileExpr(e.obj)
+		c.emit(vmGetField, c.addString(e.name), e.loc)
+
+	case *execExprDotSet:
+		c.compileExpr(e.obj)
+		c.compileExpr(e.val)
+		c.emit(vmSetField, c.addString(e.name), e.loc)
+
+	case *execExprFuncCall:
+		c.emit(vmStep, 0, e.loc)
+		c.compileExpr(e.fun)
+		c.emit(vmCheckCallable, 0, e.loc)
+		c.compileExprs(e.args)
+		c.emit(vmCall, int32(len(e.args)), e.loc)
+
+	case *execExprOperator:
+		c.compileOperator(e)
+
+	case *execExprMethodCall:
+		c.emit(vmStep, 0, e.loc)
+		c.compileExpr(e.obj)
+		c.emit(vmMethod, c.addString(e.name), e.loc)
+		c.compileExprs(e.args)
+		c.emit(vmCall, int32(len(e.args)), e.loc)
+
+	case *execExprAnd:
+		c.compileExpr(e.left)
+		jump_false := c.emit(vmJumpIfFalse, 0, SrcLoc{})
+		c.compileExpr(e.right)
+		c.emit(vmToBool, 0, SrcLoc{})
+		jump_end := c.emit(vmJump, 0, SrcLoc{})
+		c.patch(jump_false)
+		c.emit(vmConst, c.addConst(NewValueBool(false)), SrcLoc{})
+		c.patch(jump_end)
+
+	case *execExprOr:
+		c.compileExpr(e.left)
+		jump_true := c.emit(vmJumpIfTrue, 0, SrcLoc{})
+		c.compileExpr(e.right)
+		c.emit(vmToBool, 0, SrcLoc{})
+		jump_end := c.emit(vmJump, 0, SrcLoc{})
+		c.patch(jump_true)
+		c.emit(vmConst, c.addConst(NewValueBool(true)), SrcLoc{})
+		c.patch(jump_end)
+
+	case *execExprNot:
+		c.compileExpr(e.val)
+		c.emit(vmNot, 0, SrcLoc{})
+
+	default:
+		panic(fmt.Sprintf("vm: can't compile expression of type %T", expr))
+	}
+}
+
+// the operator node is already counted; arithmetic counts its nodes
+// when it runs, the code after it only when it can't be used
+func (c *vmCompiler) compileOperator(e *execExprOperator) {
+	var arith *vmArithExpr
+	if !c.no_arith {
+		arith = newVMArith(e)
+	}
+	if arith != nil {
+		c.nodes--
+		c.code.ariths = append(c.code.ariths, arith)
+		c.emit(vmArith, int32(len(c.code.ariths)-1), SrcLoc{})
+		c.nodes = 1
+		c.no_arith = true
+		defer func() {
+			c.no_arith = false
+			arith.end = c.label()
+		}()
+	}
+
+	c.code.operators = append(c.code.operators, e)
+	index := int32(len(c.code.operators) - 1)
+	c.emit(vmOperatorStart, index, e.call.loc)
+	c.compileExprs(e.call.args)
+	c.emit(vmOperator, index, e.call.loc)
+}
+
+// -------------------------------------------------------------------
+// virtual machine
+
+func (e *execExprOperator) isBuiltinIn(globals []Value) bool {
+	fun, ok := globals[e.ident.ref.index].(*ValueNativeFunction)
+	return ok && fun == e.fun
+}
+
+// run the code in an env holding the function arguments
+func (code *vmCode) run(env *Env) (Value, error) {
+	run := env.run
+	steps, max_steps := int64(0), int64(math.MaxInt64)
+	if run != nil {
+		steps, max_steps = run.steps, run.max_steps
+	}
+	genv := env.globals()
+	globals := genv.vals
+	locals := env.vals
+	cells := env.cells
+
+	var buf [16]Value
+	stack := buf[:0]
+	var err error
+	pc := 0
+	for err == nil {
+		in := code.instrs[pc]
+		pc++
+		steps += int64(in.nodes)
+		if in.check && steps > max_steps {
+			err = run.stepLimitError(&code.locs[pc-1])
+			break
+		}
+
+		switch in.op {
+		case vmNop:
+
+		case vmConst:
+			stack = append(stack, code.consts[in.a])
+
+		case vmString:
+			str := code.consts[in.a].(*ValueString)
+			if err = run.checkString(len(str.str), &code.locs[pc-1]); err != nil {
+				break
+			}
+			stack = append(stack, str)
+
+		case vmLoadLocal, vmLoadCell, vmLoadGlobal:
+			var val Value
+			switch in.op {
+			case vmLoadLocal:
+				val = locals[in.a]
+			case vmLoadCell:
+				if cell := cells[in.a]; cell != nil {
+					val = cell.val
+				}
+			default:
+				val = globals[in.a]
+			}
+			if val == nil {
+				err = newExecError(&code.locs[pc-1], fmt.Sprintf("variable '%s' is not initialized yet", code.names[pc-1]))
+				break
+			}
+			stack = append(stack, val)
+
+		case vmFolded:
+			fold := code.folds[in.a]
+			if fold.expr.holds(env) {
+				stack = append(stack, fold.expr.val)
+				pc = fold.end
+			}
+
+		case vmGuards:
+			guard := code.guards[in.a]
+			if !guardsHold(guard.guards, env) {
+				pc = guard.orig
+			}
+
+		case vmArith:
+			arith := code.ariths[in.a]
+			val, ok := arith.eval(locals, cells, globals)
+			if !ok {
+				break
+			}
+			steps += arith.nodes
+			if steps > max_steps {
+				err = run.stepLimitError(&arith.loc)
+				break
+			}
+			stack = append(stack, val)
+			pc = arith.end
+
+		case vmStoreLocal:
+			locals[in.a] = stack[len(stack)-1]
+
+		case vmSetLocal:
+			locals[in.a] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+		case vmStoreCell:
+			cell := cells[in.a]
+			if cell == nil {
+				err = newExecError(&code.locs[pc-1], fmt.Sprintf("unknown variable '%s' in assignment", code.names[pc-1]))
+				break
+			}
+			cell.val = stack[len(stack)-1]
+
+		case vmStoreGlobal:
+			if int(in.a) >= len(globals) {
+				err = newExecError(&code.locs[pc-1], fmt.Sprintf("unknown variable '%s' in assignment", code.names[pc-1]))
+				break
+			}
+			globals[in.a] = stack[len(stack)-1]
+
+		case vmNewCell:
+			cells[in.a] = &valueCell{stack[len(stack)-1]}
+			stack = stack[:len(stack)-1]
+
+		case vmPop:
+			stack = stack[:len(stack)-1]
+
+		case vmJump:
+			pc = int(in.a)
+
+		case vmJumpIfFalse:
+			val := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !valueIsTrue(val) {
+				pc = int(in.a)
+			}
+
+		case vmJumpIfTrue:
+			val := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if valueIsTrue(val) {
+				pc = int(in.a)
+			}
+
+		case vmToBool:
+			stack[len(stack)-1] = NewValueBool(valueIsTrue(stack[len(stack)-1]))
+
+		case vmNot:
+			stack[len(stack)-1] = NewValueBool(!valueIsTrue(stack[len(stack)-1]))
+
+		case vmClosure:
+			stack = append(stack, newClosure(code.funcs[in.a], env))
+
+		case vmVector:
+			if err = run.checkElements("vector", int(in.a), &code.locs[pc-1]); err != nil {
+				break
+			}
+			n := len(stack) - int(in.a)
+			elements := make([]Value, in.a)
+			copy(elements, stack[n:])
+			stack = append(stack[:n], &ValueVector{elements: elements})
+
+		case vmMap:
+			if err = run.checkElements("map", int(in.a), &code.locs[pc-1]); err != nil {
+				break
+			}
+			n := len(stack) - 2*int(in.a)
+			elements := make([][2]Value, in.a)
+			for i := range elements {
+				elements[i] = [2]Value{stack[n+2*i], stack[n+2*i+1]}
+			}
+			stack = append(stack[:n], NewValueMap(elements))
+
+		case vmIndex:
+			loc := &code.locs[pc-1]
+			n := len(stack) - 2
+			container, index := stack[n], stack[n+1]
+			c, ok := container.(ValueContainer)
+			if !ok {
+				err = newExecError(loc, fmt.Sprintf("trying to index non-containver value of type '%s'", container.Type()))
+				break
+			}
+			var val Value
+			if val, err = c.Get(index, loc); err != nil {
+				break
+			}
+			stack = append(stack[:n], val)
+
+		case vmCheckContainer:
+			container := stack[len(stack)-1]
+			if _, ok := container.(ValueContainer); !ok {
+				err = newExecError(&code.locs[pc-1], fmt.Sprintf("trying to set value of non-container object of type '%s'", container.Type()))
+			}
+
+		case vmSetIndex:
+			loc := &code.locs[pc-1]
+			n := len(stack) - 3
+			container, index, val := stack[n], stack[n+1], stack[n+2]
+			if err = run.checkSetIndex(container, index, loc); err != nil {
+				break
+			}
+			if err = container.(ValueContainer).Set(index, val, loc); err != nil {
+				break
+			}
+			stack = append(stack[:n], val)
+
+		case vmGetField:
+			name := code.consts[in.a].(*ValueString)
+			var val Value
+			if val, err = getField(stack[len(stack)-1], name.str, name, &code.locs[pc-1]); err != nil {
+				break
+			}
+			stack[len(stack)-1] = val
+
+		case vmSetField:
+			loc := &code.locs[pc-1]
+			n := len(stack) - 2
+			obj, val := stack[n], stack[n+1]
+			name := code.consts[in.a].(*ValueString)
+			switch o := obj.(type) {
+			case ValueObject:
+				err = o.SetField(name.str, val, loc)
+
+			case ValueContainer:
+				err = run.checkSetIndex(obj, name, loc)
+				if err == nil {
+					err = o.Set(name, val, loc)
+				}
+
+			default:
+				err = newExecError(loc, fmt.Sprintf("trying to set field '%s' of value of type '%s'", name.str, obj.Type()))
+			}
+			stack = append(stack[:n], val)
+
+		case vmMethod:
+			loc := &code.locs[pc-1]
+			obj := stack[len(stack)-1]
+			name := code.consts[in.a].(*ValueString)
+			if o, ok := obj.(ValueObject); ok {
+				if method, ok := o.Method(name.str); ok {
+					stack[len(stack)-1] = NewValueNativeFunction(func(args []Value, env *Env, loc *SrcLoc) (Value, error) {
+						return method(o, args, env, loc)
+					})
+					break
+				}
+			}
+			var fun Value
+			if fun, err = getField(obj, name.str, name, loc); err != nil {
+				break
+			}
+			if _, ok := fun.(ValueCallable); !ok {
+				err = newExecError(loc, fmt.Sprintf("trying to call non-function value of type '%s'", fun.Type()))
+				break
+			}
+			stack[len(stack)-1] = fun
+
+		case vmCheckCallable:
+			fun := stack[len(stack)-1]
+			if _, ok := fun.(ValueCallable); !ok {
+				err = newExecError(&code.locs[pc-1], fmt.Sprintf("trying to call non-function value of type '%s'", fun.Type()))
+			}
+
+		case vmOperatorStart:
+			e := code.operators[in.a]
+			if e.isBuiltinIn(globals) {
+				stack = append(stack, nil)
+				break
+			}
+
+			// called like a function: count the call and the operator variable
+			loc := &code.locs[pc-1]
+			steps += 2
+			if steps > max_steps {
+				err = run.stepLimitError(loc)
+				break
+			}
+			if err = run.checkDone(loc); err != nil {
+				break
+			}
+			fun := globals[e.ident.ref.index]
+			if fun == nil {
+				err = newExecError(&e.ident.loc, fmt.Sprintf("variable '%s' is not initialized yet", e.ident.name))
+				break
+			}
+			if _, ok := fun.(ValueCallable); !ok {
+				err = newExecError(loc, fmt.Sprintf("trying to call non-function value of type '%s'", fun.Type()))
+				break
+			}
+			stack = append(stack, fun)
+
+		case vmCall, vmOperator:
+			loc := &code.locs[pc-1]
+			argc := int(in.a)
+			if in.op == vmOperator {
+				e := code.operators[in.a]
+				argc = len(e.call.args)
+				if n := len(stack) - argc; stack[n-1] == nil {
+					var y Value
+					if argc > 1 {
+						y = stack[n+1]
+					}
+					var val Value
+					if val, err = e.op.apply(stack[n], y, loc); err != nil {
+						break
+					}
+					stack = append(stack[:n-1], val)
+					break
+				}
+			}
+			n := len(stack) - argc
+			args := make([]Value, argc)
+			copy(args, stack[n:])
+			fun := stack[n-1].(ValueCallable)
+			if run != nil {
+				run.steps = steps
+			}
+			var ret Value
+			ret, err = fun.Call(args, env, loc)
+			if run != nil {
+				steps = run.steps
+			}
+			globals = genv.vals
+			if err != nil {
+				break
+			}
+			if err = run.checkSize(ret, loc); err != nil {
+				break
+			}
+			stack = append(stack[:n-1], ret)
+
+		case vmStep:
+			err = run.checkDone(&code.locs[pc-1])
+
+		case vmReturn:
+			if run != nil {
+				run.steps = steps
+			}
+			return stack[len(stack)-1], nil
+		}
+	}
+	if run != nil {
+		run.steps = steps
+	}
+	return nil, err
+}
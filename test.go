@@ -1,33 +1,159 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
         "./narfscript"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("USAGE: %s filename\n", os.Args[0])
+	script := flag.Bool("script", false, "run top level statements instead of main()")
+	color := flag.Bool("color", false, "use colors in error messages")
+	lint := flag.Bool("lint", false, "print lint warnings as JSON instead of running")
+	backend := flag.String("backend", "tree", "execution backend: tree or vm")
+	bench := flag.Int("bench", 0, "call main() this many times without output and print the time per call")
+	conformance := flag.String("conformance", "", "run the scripts in a directory with both backends and compare the output")
+	flag.Parse()
+	if *conformance != "" {
+		if !runConformance(*conformance) {
+			os.Exit(1)
+		}
 		return
 	}
-	filename := os.Args[1]
-	args := make([]narfscript.Value, 0, len(os.Args)-2)
-	for _, arg := range os.Args[2:] {
+	if flag.NArg() < 1 {
+		fmt.Printf("USAGE: %s [-script] [-color] [-lint] [-backend tree|vm] [-bench n] filename\n", os.Args[0])
+		fmt.Printf("       %s -conformance dir\n", os.Args[0])
+		return
+	}
+	filename := flag.Arg(0)
+	args := make([]narfscript.Value, 0, flag.NArg()-1)
+	for _, arg := range flag.Args()[1:] {
 		args = append(args, narfscript.NewValueString(arg))
 	}
 
 	narf := narfscript.NewNarf()
+	narf.SetScriptMode(*script)
+	switch *backend {
+	case "tree":
+		narf.SetBackend(narfscript.BackendTree)
+	case "vm":
+		narf.SetBackend(narfscript.BackendVM)
+	default:
+		fmt.Printf("invalid backend: '%s'\n", *backend)
+		return
+	}
+	diag := narf.Diagnostics()
+	diag.Color = *color
 	if err := narf.Parse(filename); err != nil {
-		fmt.Printf("%s\n", err)
+		diag.Print(os.Stdout, err)
+		return
+	} else if *lint {
+		out, _ := json.MarshalIndent(narf.Lint(), "", "  ")
+		fmt.Printf("%s\n", out)
+		return
+	} else if *bench > 0 {
+		runBench(narf, args, *bench)
 		return
 	} else {
 		narf.DumpEnv()
 		narf.DumpFunctions()
 	}
 
+	if *script {
+		ret, err := narf.Run()
+		if err != nil {
+			diag.Print(os.Stdout, err)
+		} else {
+			fmt.Printf("%s\n", ret)
+		}
+		return
+	}
+
 	_, err := narf.CallFunction("main", args)
 	if err != nil {
-		fmt.Printf("%s\n", err)
+		diag.Print(os.Stdout, err)
+	}
+}
+
+func runBench(narf *narfscript.Narf, args []narfscript.Value, n int) {
+	narf.SetOutput(io.Discard)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if _, err := narf.CallFunction("main", args); err != nil {
+			narf.Diagnostics().Print(os.Stdout, err)
+			return
+		}
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("%d calls, %v per call\n", n, elapsed/time.Duration(n))
+}
+
+// runs every dir/*.tst script with each backend, comparing the output of
+// main() (followed by the error it returns, if any) with dir/*.out
+func runConformance(dir string) bool {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tst"))
+	if err != nil || len(files) == 0 {
+		fmt.Printf("no scripts found in '%s'\n", dir)
+		return false
+	}
+	backends := []struct {
+		name    string
+		backend narfscript.Backend
+	}{
+		{"tree", narfscript.BackendTree},
+		{"vm", narfscript.BackendVM},
+	}
+
+	ok := true
+	for _, file := range files {
+		want, err := os.ReadFile(strings.TrimSuffix(file, ".tst") + ".out")
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", file, err)
+			ok = false
+			continue
+		}
+		for _, b := range backends {
+			got := runCaptured(file, b.backend)
+			if normalizeNewlines(got) != normalizeNewlines(string(want)) {
+				fmt.Printf("FAIL %s [%s]\n--- got:\n%s--- want:\n%s", file, b.name, got, want)
+				ok = false
+			} else {
+				fmt.Printf("ok   %s [%s]\n", file, b.name)
+			}
+		}
+	}
+	return ok
+}
+
+func runCaptured(file string, backend narfscript.Backend) string {
+	var out bytes.Buffer
+	f, err := os.Open(file)
+	if err != nil {
+		return err.Error() + "\n"
+	}
+	defer f.Close()
+
+	narf := narfscript.NewNarf()
+	narf.SetBackend(backend)
+	narf.SetOutput(&out)
+	diag := narf.Diagnostics()
+	if err := narf.ParseReader(filepath.Base(file), f); err != nil {
+		diag.Print(&out, err)
+		return out.String()
 	}
+	if _, err := narf.CallFunction("main", nil); err != nil {
+		diag.Print(&out, err)
+	}
+	return out.String()
+}
+
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
 }
@@ -0,0 +1,11 @@
+function main() {
+    println(1 + 2 * 3, (1 + 2) * 3, 7 / 2, 7 % 3, 2 ^ 10, -5 + 2);
+    println(1 < 2, 2 <= 2, 3 > 4, 3 >= 4, 1 == 1, 1 != 1);
+    printf("%d %g %s\n", 42, 0.5, "str");
+    var x = 10;
+    x = x - 3;
+    println(x);
+    var a = 1;
+    var b = a = 5;
+    println(a, b);
+}
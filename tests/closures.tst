@@ -0,0 +1,30 @@
+function make_counter() {
+    var count = 0;
+    return function() {
+        count = count + 1;
+        return count;
+    };
+}
+
+function adder(n) {
+    return function(x) { return x + n; };
+}
+
+function main() {
+    var c1 = make_counter();
+    var c2 = make_counter();
+    println(c1(), c1(), c1(), c2());
+
+    var add5 = adder(5);
+    println(add5(10), adder(1)(1));
+
+    var fns = [];
+    var i = 0;
+    while (i < 3) {
+        var j = i * 10;
+        fns[i] = function() { return j; };
+        i = i + 1;
+    }
+    println(fns[0](), fns[1](), fns[2]());
+    println(make_counter);
+}
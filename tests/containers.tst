@@ -0,0 +1,21 @@
+function main() {
+    var v = [ 1, "two", [ 3 ] ];
+    println(v, v[0], v[1], v[2][0]);
+    v[3] = 4;
+    v[0] = v[0] + 10;
+    println(v);
+
+    var m = { "a" : 1, "b" : [ 2 ] };
+    println(m, m["a"], m.b[0]);
+    m["c"] = 3;
+    m.d = "four";
+    m.a = m.a + 1;
+    println(m);
+
+    var obj = { "n" : 0 };
+    obj.inc = function(by) {
+        obj.n = obj.n + by;
+        return obj.n;
+    };
+    println(obj.inc(2), obj.inc(3), obj.n);
+}
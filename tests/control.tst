@@ -0,0 +1,54 @@
+function log(msg) {
+    if (msg == null)
+        return;
+    println(msg);
+}
+
+function odd_sum(n) {
+    var i = 0;
+    var sum = 0;
+    while (i < n) {
+        i = i + 1;
+        var rem = i % 2;
+        if (rem != 0)
+            sum = sum + i;
+    }
+    return sum;
+}
+
+function find(v, x) {
+    var i = 0;
+    while (true) {
+        if (i >= 10)
+            break;
+        var j = 0;
+        while (j < 10) {
+            j = j + 1;
+            if (j >= 3) {
+                if (v[i] == x)
+                    return [ i, j ];
+                break;
+            }
+        }
+        i = i + 1;
+    }
+    return null;
+}
+
+function main() {
+    log("start");
+    println(log(null), log);
+    println(odd_sum(10));
+    println(find([ 5, 6, 7, 8, 9, 10, 11, 12, 13, 14 ], 8), find([ 0, 0, 0, 0, 0, 0, 0, 0, 0, 0 ], 1));
+    var fns = [];
+    var i = 0;
+    while (i < 4) {
+        var k = i;
+        i = i + 1;
+        if (k != 1)
+            fns = [ fns, function() { return k; } ];
+    }
+    println(fns[1](), fns[0][1](), fns[0][0][1]());
+    var continue = 2;
+    println(continue * 3);
+}
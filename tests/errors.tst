@@ -0,0 +1,13 @@
+function inner(v) {
+    return v[5];
+}
+
+function outer(v) {
+    return inner(v) + 1;
+}
+
+function main() {
+    println("before");
+    outer([ 1, 2 ]);
+    println("after");
+}
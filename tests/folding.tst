@@ -0,0 +1,38 @@
+var PI2 = 2 * 3.14159;
+
+function area(r) {
+    return PI2 / 2 * r * r;
+}
+
+function flags() {
+    var n = 0;
+    if (false) {
+        n = n + 100;
+    }
+    if (1 < 2 && "a" != "b") {
+        n = n + 1;
+    } else {
+        n = n + 1000;
+    }
+    while (!true) {
+        n = n + 10000;
+    }
+    if (null || 0 || "") {
+        n = n + 10;
+    }
+    return n;
+}
+
+function main() {
+    var i = 0;
+    var total = 0;
+    while (i < 3) {
+        total = total + area(i) + 2 ^ 3 - -1;
+        i = i + 1;
+    }
+    println(PI2, total, flags(), "x" == "x", -(4 % 3));
+    false = true;
+    println(flags(), !false);
+    false = !true;
+    println(flags(), 10 / 4 * "2", 1 + "two");
+}
@@ -0,0 +1,22 @@
+function main() {
+    var big = 9007199254740993;
+    println(big, big + 1, big == 9007199254740992.0, big - 1 == 9007199254740992.0);
+    println(big > 9007199254740992.0, big < 9007199254740992.0, big - 1 >= 9007199254740992.0, 1 < 1.5, -2 > -2.5);
+    var max = 9223372036854775807;
+    println(max + 1, -max - 1, -9223372036854775808, -max - 2, max * 2, 3 ^ 40, 2 ^ 62, 2 ^ 64, 2 ^ -1);
+    println(7 / 2, 6 / 3, div(7, 2), div(-7, 2), -7 % 2, 7 % -2, 7.5 % 2);
+    println(1 + 0.5, 2 * 1.5, 1 == 1.0, 1 != 1.0, 2 < 2.5, 10 > 9.99);
+    printf("%d %d %d %g\n", max, 3.0, -12, 42);
+    println(bit_and(12, 10), bit_or(12, 10), bit_xor(12, 10), bit_not(0));
+    println(shift_left(1, 40), shift_right(-16, 2), shift_left(1, 64));
+    println(int(3.9), int(-3.9), int(5), float(3) / 2, int(2.5) / 2);
+
+    var m = {};
+    m[1] = "one";
+    m[2.0] = "two";
+    println(m[1.0], m[2], m[big], m);
+
+    var v = [ 10, 20, 30 ];
+    println(v[1], v[2.0], 0 || 1, !0);
+    println(5 % 0);
+}
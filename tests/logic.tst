@@ -0,0 +1,14 @@
+function trace(name, val) {
+    print(name, "");
+    return val;
+}
+
+function main() {
+    println(trace("a", false) && trace("b", true));
+    println(trace("a", true) && trace("b", 1));
+    println(trace("a", true) || trace("b", false));
+    println(trace("a", null) || trace("b", 0));
+    println(!true, !null, !0, !"");
+    if (!(1 > 2) && (2 > 1 || trace("c", false)))
+        println("ok");
+}
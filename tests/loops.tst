@@ -0,0 +1,26 @@
+function main() {
+    var i = 0;
+    var total = 0;
+    while (i < 5) {
+        var j = 0;
+        while (true) {
+            var k = i * j;
+            if (j >= i)
+                break;
+            total = total + k;
+            j = j + 1;
+        }
+        var after = i;
+        i = i + 1;
+        if (i == 4) {
+            var inner = i;
+            break;
+        }
+    }
+    println(i, total);
+
+    var n = 0;
+    while (n < 3)
+        n = n + 1;
+    println(n);
+}
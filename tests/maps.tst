@@ -0,0 +1,24 @@
+function main() {
+    var m = {};
+    var i = 0;
+    while (i < 2000) {
+        m[i * 3 % 2000] = i;
+        i = i + 1;
+    }
+    println(m[0], m[1.0], m[1999], m[2000]);
+
+    var small = { "b" : 1, c : 2 };
+    small[2] = "two";
+    small[true] = "yes";
+    small[null] = "nothing";
+    small[4 / 2] = "TWO";
+    small["a"] = 3;
+    println(small);
+    println(small[2.0], small[true], small[false], small[null], small["b"]);
+
+    var v = [ 1 ];
+    var w = [ 1 ];
+    var byref = {};
+    byref[v] = "v";
+    println(byref[v], byref[w]);
+}
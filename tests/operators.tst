@@ -0,0 +1,26 @@
+function square(x) {
+    return x * x;
+}
+
+function half(x) {
+    return x / 2;
+}
+
+function main() {
+    var a = 7;
+    var b = -2;
+    println(a + b, a - b, a * b, a / b, a % b, -a % 3, b ^ 3, -b);
+    println(-square(b) + half(a), square(a - b) - 3 * a);
+    println(a < b, a > b, a <= 7, b >= -2, -(a - 10));
+    println(1 == 1, "x" == "x", "x" != "y", null == null, true != false, [ 1 ] == [ 1 ]);
+    var f = square;
+    println(f == square, f != half, a == "7");
+    var i = 0;
+    var sum = 0;
+    while (i < 10) {
+        sum = sum + i * i % 7;
+        i = i + 1;
+    }
+    println(sum);
+    println(half("ten"));
+}
@@ -0,0 +1,27 @@
+function fib(n) {
+    if (n < 2)
+        return n;
+    return fib(n - 1) + fib(n - 2);
+}
+
+function fact(n) {
+    if (n <= 1)
+        return 1;
+    else
+        return n * fact(n - 1);
+}
+
+function is_even(n) {
+    if (n == 0) return true;
+    return is_odd(n - 1);
+}
+
+function is_odd(n) {
+    if (n == 0) return false;
+    return is_even(n - 1);
+}
+
+function main() {
+    println(fib(15), fact(10));
+    println(is_even(10), is_odd(7), is_even(3));
+}
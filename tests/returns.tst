@@ -0,0 +1,13 @@
+function check(x) {
+    if (x > 0)
+        return "positive";
+    return "other";
+}
+
+function main() {
+    println(check(1), check(-1));
+    var f = function() {};
+    println(f());
+    var s = 0;
+    s.x = 1;
+}
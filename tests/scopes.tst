@@ -0,0 +1,66 @@
+function outer(a) {
+    var b = 10;
+    var mid = function(c) {
+        return function() {
+            a = a + 1;
+            return a + b + c;
+        };
+    };
+    var f = mid(100);
+    var g = mid(1000);
+    println(f(), f(), g());
+    b = 20;
+    println(f(), a);
+    return f;
+}
+
+function shadow(x) {
+    var x = x * 2;
+    var get_x = function() { return x; };
+    var x = 0;
+    println(x, get_x());
+    {
+        var x = "inner";
+        println(x);
+    }
+    println(x);
+}
+
+function per_iteration() {
+    var fns = [];
+    var i = 0;
+    while (i < 3) {
+        var n = i;
+        var set = function(v) { n = v; };
+        fns[i] = [ function() { return n; }, set ];
+        i = i + 1;
+    }
+    fns[1][1](42);
+    println(fns[0][0](), fns[1][0](), fns[2][0]());
+}
+
+function swap_counter() {
+    var count = 0;
+    var counter = {
+        "inc" : function() { count = count + 1; return count; },
+        "get" : function() { return count; },
+    };
+    counter.inc();
+    counter.inc();
+    return counter;
+}
+
+function main() {
+    var f = outer(1);
+    println(f());
+    shadow(21);
+    per_iteration();
+    println(swap_counter().get());
+    var fact = null;
+    fact = function(n) {
+        if (n <= 1)
+            return 1;
+        return n * fact(n - 1);
+    };
+    println(fact(5));
+}
@@ -0,0 +1,10 @@
+function main() {
+    var s = "hello";
+    var t = [ s, "world" ];
+    println(t[0], t[1]);
+    println(s == "hello", s != "hello", s == "Hello");
+    printf("[%s] [%s] %%\n", s, t);
+    println("tab\tand \"quotes\"");
+    print("no newline");
+    println();
+}